@@ -0,0 +1,110 @@
+package redbox
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	errNoShipThreshold   = fmt.Errorf("an AutoShipper requires a positive MaxRows or MaxBytes")
+	errAutoShipperClosed = fmt.Errorf("cannot add rows, the AutoShipper has been closed")
+)
+
+// AutoShipperOptions specifies when an AutoShipper ships its box.
+// At least one threshold is required, shipping at whichever is hit first.
+type AutoShipperOptions struct {
+	// MaxRows is the number of rows to accumulate before shipping.
+	MaxRows int
+
+	// MaxBytes is the total size of rows, in bytes, to accumulate before shipping.
+	MaxBytes int
+}
+
+// AutoShipper is a fire-and-forget ingester around a Redbox. Rows are packed until
+// a configured threshold accumulates, at which point the box is shipped and reset.
+// AutoShipper is concurrency safe.
+type AutoShipper struct {
+	// Inherit mutex locking/unlocking
+	mt sync.Mutex
+
+	// box is the wrapped Redbox
+	box API
+
+	// o holds the thresholds triggering a ship
+	o AutoShipperOptions
+
+	// rows and bytes track what's been packed since the last ship
+	rows  int
+	bytes int
+
+	// closed indicates the AutoShipper accepts no further rows
+	closed bool
+}
+
+// NewAutoShipper wraps the given box, shipping it whenever the configured thresholds are hit.
+func NewAutoShipper(box API, options AutoShipperOptions) (*AutoShipper, error) {
+	if options.MaxRows <= 0 && options.MaxBytes <= 0 {
+		return nil, errNoShipThreshold
+	}
+	return &AutoShipper{
+		box: box,
+		o:   options,
+	}, nil
+}
+
+// Add packs a single row, shipping and resetting the box if a threshold has been hit.
+// If shipping fails the packed data is kept, and shipping is reattempted on the next Add or Close.
+// As a failed ship leaves the box sealed, the next Add retries it before packing its row,
+// returning the error without packing the row if the retry fails too.
+func (as *AutoShipper) Add(row []byte) error {
+	as.mt.Lock()
+	defer as.mt.Unlock()
+	if as.closed {
+		return errAutoShipperClosed
+	}
+
+	if as.thresholdHit() {
+		if err := as.ship(); err != nil {
+			return err
+		}
+	}
+
+	if err := as.box.Pack(row); err != nil {
+		return err
+	}
+	as.rows++
+	as.bytes += len(row)
+
+	if as.thresholdHit() {
+		return as.ship()
+	}
+	return nil
+}
+
+// Close ships any remaining rows, after which no more rows can be added.
+// If shipping fails, calling Close again reattempts it.
+func (as *AutoShipper) Close() error {
+	as.mt.Lock()
+	defer as.mt.Unlock()
+	as.closed = true
+	return as.ship()
+}
+
+// thresholdHit indicates whether the rows packed since the last ship should be shipped.
+func (as *AutoShipper) thresholdHit() bool {
+	return (as.o.MaxRows > 0 && as.rows >= as.o.MaxRows) || (as.o.MaxBytes > 0 && as.bytes >= as.o.MaxBytes)
+}
+
+// ship ships and resets the box if any rows were packed since the last ship.
+// A failed ship keeps the rows counted, so they're shipped by the next attempt.
+func (as *AutoShipper) ship() error {
+	if as.rows == 0 {
+		return nil
+	}
+	if _, err := as.box.ShipAndContinue(); err != nil {
+		return err
+	}
+	as.rows = 0
+	as.bytes = 0
+	return nil
+}
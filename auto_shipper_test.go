@@ -0,0 +1,107 @@
+package redbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// expectShips sets the SQL calls expected for the given number of single manifest ships.
+func expectShips(mock sqlmock.Sqlmock, redbox *Redbox, nShips int) {
+	for i := 0; i < nShips; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+}
+
+func TestAutoShipperShipsAtRowThreshold(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	// 10 rows shipped every 3 rows ships 3 times, with the last row shipped on close
+	expectShips(mock, redbox, 4)
+	shipper, err := NewAutoShipper(redbox, AutoShipperOptions{MaxRows: 3})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 10; i++ {
+		assert.NoError(shipper.Add(data))
+	}
+	assert.NoError(shipper.Close())
+	assert.Equal(errAutoShipperClosed, shipper.Add(data))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAutoShipperShipsAtByteThreshold(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+
+	// Shipping every 2 rows worth of bytes ships exactly 3 times for 6 rows,
+	// leaving nothing to ship on close.
+	expectShips(mock, redbox, 3)
+	shipper, err := NewAutoShipper(redbox, AutoShipperOptions{MaxBytes: 2 * len(data)})
+	assert.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(shipper.Add(data))
+		}()
+	}
+	wg.Wait()
+	assert.NoError(shipper.Close())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAutoShipperFailedShip(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	s3Box := &MockSuccessS3Box{}
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	// The first COPY fails, keeping its rows, which the next Add ships before packing its own
+	copyErr := fmt.Errorf("copy failed")
+	mock.ExpectBegin()
+	mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnError(copyErr)
+	mock.ExpectRollback()
+	expectShips(mock, redbox, 2)
+	shipper, err := NewAutoShipper(redbox, AutoShipperOptions{MaxRows: 2})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(shipper.Add(data))
+	assert.Equal(copyErr, shipper.Add(data))
+	assert.Equal(2, s3Box.rows)
+	assert.NoError(shipper.Add(data))
+	assert.Equal(1, s3Box.rows)
+	assert.NoError(shipper.Close())
+	assert.NoError(shipper.Close())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAutoShipperRequiresThreshold(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewAutoShipper(newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil), AutoShipperOptions{})
+	assert.Equal(errNoShipThreshold, err)
+}
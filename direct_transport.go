@@ -0,0 +1,234 @@
+package redbox
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cgclever/redbox/s3box"
+)
+
+const (
+	// defaultDirectBatchSize is the default number of rows inserted per INSERT statement
+	defaultDirectBatchSize = 100
+
+	// maxInsertParams is the most bind parameters Postgres, and so Redshift, accepts in a statement
+	maxInsertParams = 32767
+
+	// tableColumnsQuery lists the columns of a table, which rows' keys are matched against
+	tableColumnsQuery = "SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2"
+)
+
+var errNotSupportedByDirectTransport = fmt.Errorf("manifests and s3 data files aren't used by the direct transport")
+
+// Transport determines how packed data reaches Redshift.
+type Transport int
+
+const (
+	// TransportS3 stages data files in s3 and COPYs them into Redshift. This is the default.
+	TransportS3 Transport = iota
+
+	// TransportDirect buffers rows in memory and ships them with batched, parameterized
+	// INSERT statements, bypassing s3 entirely. Redshift INSERTs are far slower than a
+	// COPY, so this is only appropriate for small loads, e.g. up to a few thousand rows.
+	TransportDirect
+)
+
+// rowBuffer is the s3box.API used by the direct transport, holding packed rows in memory.
+type rowBuffer struct {
+	mt   sync.Mutex
+	rows [][]byte
+}
+
+// Pack buffers a copy of the row.
+func (b *rowBuffer) Pack(data []byte) error {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+	b.rows = append(b.rows, append([]byte(nil), data...))
+	return nil
+}
+
+// Flush is a no-op, rows are only ever held in memory.
+func (b *rowBuffer) Flush() error {
+	return nil
+}
+
+// CreateManifests isn't supported, as no data is staged in s3.
+func (b *rowBuffer) CreateManifests(manifestSlug string, nManifests int) ([]string, error) {
+	return nil, errNotSupportedByDirectTransport
+}
+
+// PlanManifests isn't supported, as no data is staged in s3.
+func (b *rowBuffer) PlanManifests(manifestSlug string, nManifests int) ([]string, error) {
+	return nil, errNotSupportedByDirectTransport
+}
+
+// WriteMetadata isn't supported, as no data is staged in s3.
+func (b *rowBuffer) WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error) {
+	return "", errNotSupportedByDirectTransport
+}
+
+// DataFiles isn't supported, as no data is staged in s3.
+func (b *rowBuffer) DataFiles() ([]string, error) {
+	return nil, errNotSupportedByDirectTransport
+}
+
+// Stats reports the buffered rows. There are never any files.
+func (b *rowBuffer) Stats() s3box.Stats {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+	return s3box.Stats{Rows: len(b.rows)}
+}
+
+// HasData indicates whether any rows are buffered.
+func (b *rowBuffer) HasData() bool {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+	return len(b.rows) > 0
+}
+
+// Reset discards all buffered rows.
+func (b *rowBuffer) Reset() {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+	b.rows = nil
+}
+
+// bufferedRows returns the rows packed so far.
+func (b *rowBuffer) bufferedRows() [][]byte {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+	return b.rows
+}
+
+// insertToRedshift loads the rows with batched INSERT statements in a single transaction.
+// Like a COPY with JSON 'auto', keys without a matching column are ignored, and columns
+// missing from a row take their DEFAULT.
+func (rb *Redbox) insertToRedshift(schema, table string, rows [][]byte) error {
+	parsedRows := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		decoder := json.NewDecoder(bytes.NewReader(row))
+		decoder.UseNumber() // Preserve numbers exactly, rather than as float64
+		if err := decoder.Decode(&parsedRows[i]); err != nil {
+			return errInvalidJSONInput
+		}
+	}
+
+	return rb.loadToRedshift(schema, table, func(tx *sql.Tx) error {
+		columns, err := insertColumns(tx, schema, table, parsedRows)
+		if err != nil {
+			return err
+		}
+
+		batchSize := rb.o.DirectBatchSize
+		if batchSize <= 0 {
+			batchSize = defaultDirectBatchSize
+		}
+		if batchSize*len(columns) > maxInsertParams {
+			batchSize = maxInsertParams / len(columns)
+		}
+		if len(columns) == 0 {
+			// Rows without any columns are inserted with DEFAULT VALUES, which takes a single row
+			batchSize = 1
+		}
+
+		for start := 0; start < len(parsedRows); start += batchSize {
+			end := start + batchSize
+			if end > len(parsedRows) {
+				end = len(parsedRows)
+			}
+			stmt, args, err := insertStatement(schema, table, columns, parsedRows[start:end])
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(stmt, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// insertColumns returns the columns of the table which any of the rows has a key for, sorted.
+func insertColumns(tx *sql.Tx, schema, table string, rows []map[string]interface{}) ([]string, error) {
+	result, err := tx.Query(tableColumnsQuery, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	tableColumns := map[string]bool{}
+	for result.Next() {
+		var column string
+		if err := result.Scan(&column); err != nil {
+			return nil, err
+		}
+		tableColumns[column] = true
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	columnSet := map[string]bool{}
+	for _, row := range rows {
+		for column := range row {
+			if tableColumns[column] {
+				columnSet[column] = true
+			}
+		}
+	}
+	var columns []string
+	for column := range columnSet {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns, nil
+}
+
+// insertStatement generates a parameterized multi-row INSERT of the given rows and its arguments.
+// Nested objects and arrays are inserted as their JSON text, like a COPY with JSON 'auto'.
+// Columns missing from a row are inserted as DEFAULT, while explicit nulls are inserted as NULL.
+// Without any columns, a single row of DEFAULT VALUES is inserted.
+func insertStatement(schema, table string, columns []string, rows []map[string]interface{}) (string, []interface{}, error) {
+	if len(columns) == 0 {
+		return fmt.Sprintf("INSERT INTO \"%s\".\"%s\" DEFAULT VALUES", schema, table), nil, nil
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = quoteIdentifier(column)
+	}
+
+	var args []interface{}
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		params := make([]string, len(columns))
+		for j, column := range columns {
+			arg, ok := row[column]
+			if !ok {
+				params[j] = "DEFAULT"
+				continue
+			}
+			switch value := arg.(type) {
+			case json.Number:
+				arg = value.String()
+			case map[string]interface{}, []interface{}:
+				nested, err := json.Marshal(value)
+				if err != nil {
+					return "", nil, err
+				}
+				arg = string(nested)
+			}
+			args = append(args, arg)
+			params[j] = fmt.Sprintf("$%d", len(args))
+		}
+		values[i] = fmt.Sprintf("(%s)", strings.Join(params, ","))
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO \"%s\".\"%s\" (%s) VALUES %s",
+		schema, table, strings.Join(quotedColumns, ","), strings.Join(values, ","))
+	return stmt, args, nil
+}
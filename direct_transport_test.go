@@ -0,0 +1,153 @@
+package redbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// expectTableColumns sets the query of the destination table's columns to return the given columns.
+func expectTableColumns(mock sqlmock.Sqlmock, columns ...string) {
+	rows := sqlmock.NewRows([]string{"column_name"})
+	for _, column := range columns {
+		rows.AddRow(column)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(tableColumnsQuery)).WithArgs(schema, table).WillReturnRows(rows)
+}
+
+func TestDirectTransportBatchesInserts(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.S3Bucket = ""
+	options.Transport = TransportDirect
+	options.DirectBatchSize = 2
+	options.Truncate = true
+	redbox := newRedboxInjection(options, &rowBuffer{}, redshift)
+
+	rows := []map[string]interface{}{
+		{"id": 1, "name": "a"},
+		{"id": 2, "nested": map[string]interface{}{"key": "value"}},
+		{"id": 12345678901234567, "name": nil},
+	}
+	for _, row := range rows {
+		data, _ := json.Marshal(row)
+		assert.NoError(redbox.Pack(data))
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", schema, table))).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectTableColumns(mock, "id", "name", "nested", "created_at")
+
+	// Missing keys take the column's DEFAULT, while explicit nulls are inserted as NULL
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "test"."test" ("id","name","nested") VALUES ($1,$2,DEFAULT),($3,DEFAULT,$4)`)).
+		WithArgs("1", "a", "2", `{"key":"value"}`).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "test"."test" ("id","name","nested") VALUES ($1,$2,DEFAULT)`)).
+		WithArgs("12345678901234567", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	manifests, err := redbox.ShipAndContinue()
+	assert.NoError(err)
+	assert.Nil(manifests)
+	assert.False(redbox.HasData())
+	_, err = redbox.Ship()
+	assert.Equal(errNothingToShip, err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDirectTransportRollsBackOnInsertError(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Transport = TransportDirect
+	redbox := newRedboxInjection(options, &rowBuffer{}, redshift)
+
+	data, _ := json.Marshal(map[string]interface{}{"id": 1})
+	assert.NoError(redbox.Pack(data))
+
+	insertErr := fmt.Errorf("Some INSERT Error")
+	mock.ExpectBegin()
+	expectTableColumns(mock, "id")
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "test"."test" ("id") VALUES ($1)`)).
+		WithArgs("1").
+		WillReturnError(insertErr)
+	mock.ExpectRollback()
+
+	_, err = redbox.Ship()
+	assert.Equal(insertErr, err)
+	assert.True(redbox.HasData())
+	_, err = redbox.Plan()
+	assert.Equal(errNotSupportedByDirectTransport, err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDirectTransportInsertsEmptyRows(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Transport = TransportDirect
+	redbox := newRedboxInjection(options, &rowBuffer{}, redshift)
+
+	// Rows without any keys have no columns to list, so each inserts its defaults
+	assert.NoError(redbox.Pack([]byte("{}")))
+	assert.NoError(redbox.Pack([]byte("{}")))
+
+	mock.ExpectBegin()
+	expectTableColumns(mock, "id")
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "test"."test" DEFAULT VALUES`)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDirectTransportIgnoresUnknownKeys(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Transport = TransportDirect
+	redbox := newRedboxInjection(options, &rowBuffer{}, redshift)
+
+	// Like a COPY with JSON 'auto', keys without a column are dropped
+	assert.NoError(redbox.Pack([]byte(`{"id":1,"extra":"x"}`)))
+	assert.NoError(redbox.Pack([]byte(`{"extra":"y"}`)))
+
+	mock.ExpectBegin()
+	expectTableColumns(mock, "id", "name")
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "test"."test" ("id") VALUES ($1),(DEFAULT)`)).
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectCommit()
+
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDirectTransportDoesNotRequireS3(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.S3Bucket = ""
+	_, err := NewRedbox(options)
+	assert.Equal(errIncompleteArgs, err)
+
+	options.Transport = TransportDirect
+	redbox, err := NewRedbox(options)
+	assert.NoError(err)
+	_, ok := redbox.s3Box.(*rowBuffer)
+	assert.True(ok)
+}
@@ -1,24 +1,62 @@
 package redbox
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/cgclever/redbox/s3box"
 )
 
-const defaultNumManifests = 4
+const (
+	defaultNumManifests = 4
+
+	// redactedCredentials stands in for the credentials of previewed COPY statements
+	redactedCredentials = "CREDENTIALS '<redacted>'"
+
+	// lastCopyIDQuery looks up the query id of the session's most recent COPY
+	lastCopyIDQuery = "SELECT pg_last_copy_id()"
+
+	// maxDirectCopyFiles is the most data files we're willing to COPY individually
+	// when manifests are disabled. Larger loads fall back to manifests.
+	maxDirectCopyFiles = 10
+)
 
 var (
-	errShippingInProgress = fmt.Errorf("cannot perform any action when shipping is in progress")
-	errIncompleteArgs     = fmt.Errorf("creating a redshift box requires a schema, table and an s3 bucket")
-	errInvalidJSONInput   = fmt.Errorf("only JSON inputs are supported")
-	errBoxShipped         = fmt.Errorf("cannot perform any actions, the box has been shipped")
-	errNothingToShip      = fmt.Errorf("cannot perform send, no data was packed")
+	errShippingInProgress    = fmt.Errorf("cannot perform any action when shipping is in progress")
+	errIncompleteArgs        = fmt.Errorf("creating a redshift box requires a schema, table and an s3 bucket")
+	errInvalidJSONInput      = fmt.Errorf("only JSON inputs are supported")
+	errBoxShipped            = fmt.Errorf("cannot perform any actions, the box has been shipped")
+	errNothingToShip         = fmt.Errorf("cannot perform send, no data was packed")
+	errIncompleteCopyKeys    = fmt.Errorf("must provide both a CopyAWSKey and CopyAWSPassword")
+	errIncompleteAWSKeys     = fmt.Errorf("must provide both an AWSKey and AWSPassword, or neither to use the environment's credentials")
+	errAmbiguousCopyCreds    = fmt.Errorf("cannot provide both a CopyIAMRole and CopyAWSKey/CopyAWSPassword")
+	errIncompleteDestination = fmt.Errorf("the DestinationFunc must return both a schema and table")
+	errInvalidTimeFormat     = fmt.Errorf("TimeFormat must be non-empty and cannot contain single quotes")
+	errInvalidDateFormat     = fmt.Errorf("DateFormat must be non-empty and cannot contain single quotes")
+	errNoRedshiftConnection  = fmt.Errorf("no RedshiftConfiguration was provided, manifests can only be prepared with PrepareManifests")
+	errInvalidTimezone       = fmt.Errorf("SessionTimezone must be a timezone name or offset, e.g. 'UTC' or 'America/New_York'")
+
+	// ErrDuplicateJSONKey signals a packed row repeating a top-level key, see RejectDuplicateKeys.
+	ErrDuplicateJSONKey = fmt.Errorf("the JSON row contains a duplicate top-level key")
+
+	// ErrEmptyRow signals a packed row without any keys, such as {}, see RejectEmptyRows.
+	ErrEmptyRow = fmt.Errorf("the JSON row is empty")
+
+	// timezonePattern matches plausible timezone names and offsets, e.g. "UTC", "America/New_York" or "+05:30"
+	timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+\-/:]+$`)
 )
 
 // Redbox manages piping data into Redshift.
@@ -42,6 +80,81 @@ type Redbox struct {
 
 	// shipped indicates if the box has been shipped
 	shipped bool
+
+	// shipRecommended is set to 1 once MaxFilesBeforeShip data files have accumulated since
+	// the last ship. It's accessed atomically rather than under mt, as the s3Box recommends
+	// ships while holding its own lock, which Reset takes while holding mt.
+	shipRecommended int32
+}
+
+// ValidationError signals a ship was aborted as the NOLOAD validation of its data failed,
+// see ValidateBeforeLoad. Nothing was loaded and the destination table is unchanged.
+type ValidationError struct {
+	// Err is the error of the failed NOLOAD COPY
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("validating the data with NOLOAD failed, nothing was loaded: %s", e.Err)
+}
+
+// ShipPlan describes everything a Ship would do, as previewed by Plan.
+type ShipPlan struct {
+	// Schema and Table are the resolved destination
+	Schema string
+	Table  string
+
+	// Manifests are the keys of the manifests a ship would create. The keys are
+	// indicative only, as their slug includes the time of shipping. Empty when
+	// the data files would be COPYed directly.
+	Manifests []string
+
+	// DataFiles are the s3 locations of the data files to be COPYed
+	DataFiles []string
+
+	// Rows is the number of rows in the data files
+	Rows int
+
+	// DeleteStatement clears the destination table ahead of the COPYs
+	// when truncating, otherwise it's empty.
+	DeleteStatement string
+
+	// CopyStatements are the COPY statements to be run, with credentials redacted
+	CopyStatements []string
+}
+
+// ShipResult describes a committed ship, as returned by ShipWithResult.
+type ShipResult struct {
+	// Schema and Table are the resolved destination
+	Schema string
+	Table  string
+
+	// Manifests are the manifests COPYed from, or the data files if COPYed directly
+	Manifests []string
+
+	// QueryIDs are the Redshift query ids of the COPYs, in order. Empty with TransportDirect.
+	QueryIDs []int64
+
+	// Rows is the number of rows loaded.
+	Rows int
+}
+
+// StageResult describes data staged in s3 by Stage, holding everything Commit needs
+// to load it. It's JSON serializable, so the load can be committed by another process.
+type StageResult struct {
+	// Schema and Table are the resolved destination
+	Schema string
+	Table  string
+
+	// Manifests are the keys of the created manifests. Empty when the data files
+	// are COPYed directly.
+	Manifests []string
+
+	// DataFiles are the s3 locations of the data files when COPYed directly, without manifests
+	DataFiles []string
+
+	// Rows is the number of rows staged
+	Rows int
 }
 
 // Options specifies the configuration for a new Redbox
@@ -53,9 +166,33 @@ type Options struct {
 	Table string
 
 	// S3Bucket specifies the intermediary bucket before ultimately piping to Redshift.
-	// The user must have both read and write access to this bucket.
+	// The user must have both read and write access to this bucket. It isn't required
+	// with the direct Transport, or with an S3AccessPointARN.
 	S3Bucket string
 
+	// S3AccessPointARN optionally stages data through an s3 access point instead of the
+	// S3Bucket, e.g. arn:aws:s3:us-west-2:123456789012:accesspoint/loads. Manifest URLs
+	// and the COPY source then reference the ARN, and the COPY omits its REGION clause.
+	S3AccessPointARN string
+
+	// S3Prefix is an optional key prefix under which all data files and manifests
+	// are staged in the S3Bucket, e.g. "redbox/".
+	S3Prefix string
+
+	// ShardID optionally identifies the box among parallel producers staging under the same
+	// S3Prefix, and is included in its data file keys so their keys can never collide.
+	// It may only contain letters, digits and dashes.
+	ShardID string
+
+	// RandomKeySuffix includes a random suffix unique to the box in its data file keys,
+	// so boxes can never collide even if created in the same nanosecond, see s3box.Options.
+	RandomKeySuffix bool
+
+	// BufferShards packs rows round-robin into this many independently flushed buffers, so
+	// concurrent Pack calls upload in parallel. Row order is then only preserved within each
+	// shard's data files, and each shard's ShardID is suffixed with its index, see s3box.ShardedS3Box.
+	BufferShards int
+
 	// S3Region is the location of the S3Bucket.
 	//
 	// If not provided Redbox will attempt to locate the region via the AWS API.
@@ -63,16 +200,63 @@ type Options struct {
 	// on the target S3 bucket for this feature.
 	S3Region string
 
+	// S3LookupRegion is the region from which the S3Region is looked up when not provided,
+	// which must lie in the bucket's partition, e.g. GovCloud or China. Defaults to the
+	// AWS_REGION or AWS_DEFAULT_REGION environment variables, falling back to us-west-1.
+	S3LookupRegion string
+
 	// AWSKey is the AWS ACCESS KEY ID
 	AWSKey string
 
 	// AWSPassword is the AWS SECRET ACCESS KEY
 	AWSPassword string
 
+	// CopyAWSKey and CopyAWSPassword are optional credentials Redshift uses to read
+	// data from s3 during the COPY. Alternatively, CopyIAMRole is the ARN of an IAM role
+	// Redshift assumes for the COPY. If none are provided, AWSKey and AWSPassword are used.
+	//
+	// This allows the credentials uploading to s3 to differ from those Redshift reads with.
+	CopyAWSKey      string
+	CopyAWSPassword string
+	CopyIAMRole     string
+
+	// VerifyWriteAccess checks the S3Bucket can be written to, and cleaned up, when the box
+	// is created, failing fast on misconfigured permissions rather than mid-load.
+	VerifyWriteAccess bool
+
+	// AWSSession is an optional AWS session to share across boxes, reusing its configuration
+	// and HTTP connection pool. If not provided, each box creates its own session, which is
+	// shared with boxes created from it by With or CloneForTable.
+	AWSSession *session.Session
+
+	// Transport determines how data reaches Redshift. By default it's staged in s3 and
+	// COPYed. TransportDirect instead holds rows in memory and ships them with batched
+	// INSERTs of DirectBatchSize rows, defaulting to 100. INSERTs perform poorly on Redshift,
+	// so this is only appropriate for small loads. Options concerning s3, manifests and the
+	// COPY are then ignored, Flush is a no-op, Plan isn't supported and Ship returns no manifests.
+	// As with a COPY of JSON 'auto', keys without a matching column are ignored, and columns
+	// missing from a row take their DEFAULT.
+	Transport       Transport
+	DirectBatchSize int
+
 	// BufferSize is the maximum size of data, in bytes, we're willing to buffer
 	// before creating an s3 file.
 	BufferSize int
 
+	// MaxRecordsPerFile optionally caps the number of rows in each s3 file, flushing
+	// at whichever of it and BufferSize is reached first.
+	MaxRecordsPerFile int
+
+	// FlushMode determines whether a Pack overflowing the buffer uploads it to s3 inline
+	// (the default), or fails with s3box.ErrBufferFull leaving the caller to call Flush.
+	FlushMode s3box.FlushMode
+
+	// NumFiles optionally splits each flush of the data into this many s3 files, e.g.
+	// to match the number of Redshift slices. Data is then held in memory until flushed
+	// and BufferSize is ignored. Without explicit flushes or BufferShards, each ship
+	// produces exactly NumFiles files, see s3box.Options.
+	NumFiles int
+
 	// NumManifests is an optional parameter choosing how many manifests
 	// to break data into. When data transfer gets to several gigabytes
 	// the user may need to experiment with larger manifest numbers to prevent
@@ -83,12 +267,187 @@ type Options struct {
 	// of data. However the number defaults to 4.
 	NumManifests int
 
+	// VisibilityRetries optionally verifies each data file is visible in s3 before writing
+	// manifests, retrying missing files up to this many times, so a COPY never fails on a
+	// transiently missing key. Files still missing fail the ship before any COPY is run.
+	VisibilityRetries int
+
+	// VerifyFilesBeforeManifest checks each data file still exists in s3 before writing
+	// manifests, failing the ship before any COPY if any were deleted, e.g. by a lifecycle
+	// policy or a concurrent cleanup. See s3box.Options.
+	VerifyFilesBeforeManifest bool
+
+	// VerifyManifestRoundtrip reads back each manifest after writing it, failing the ship before
+	// any COPY unless it parses and lists every data file assigned to it. See s3box.Options.
+	VerifyManifestRoundtrip bool
+
+	// MaxObjectSize optionally merges consecutive small data files into files of up to
+	// this many bytes before creating manifests, speeding up COPYs of loads from bursty
+	// producers. See s3box.Options.
+	MaxObjectSize int64
+
+	// BalanceManifestsBySize balances the bytes each manifest references, rather than
+	// distributing data files round-robin, see s3box.Options.
+	BalanceManifestsBySize bool
+
+	// MaxFilesPerManifest optionally caps the number of data files a single manifest
+	// references. If honoring it requires more manifests than NumManifests, more are created.
+	MaxFilesPerManifest int
+
+	// FilesPerManifest optionally puts exactly this many data files in each manifest, creating
+	// as many manifests as needed instead of NumManifests, e.g. to match the cluster's slices.
+	FilesPerManifest int
+
+	// MandatoryFunc optionally marks individual data files as optional in the manifests,
+	// e.g. possibly absent partitions, while the rest remain mandatory. See s3box.Options.
+	MandatoryFunc func(fileURL string) bool
+
+	// CompactJSON strips insignificant whitespace from each packed row before buffering it.
+	// Rows are newline delimited in s3, so pretty-printed multi-line rows would otherwise
+	// break record boundaries for the COPY. Off by default, as it costs a pass over each row.
+	CompactJSON bool
+
+	// RejectDuplicateKeys rejects packed rows repeating a top-level key with ErrDuplicateJSONKey.
+	// Go keeps the last of duplicate keys, but the COPY may not, silently loading different data.
+	// Off by default, as it costs a second pass over each row.
+	RejectDuplicateKeys bool
+
+	// RejectEmptyRows rejects packed rows without any keys, such as {} or null, with ErrEmptyRow.
+	// These load as rows of NULLs, and usually point to an upstream serialization bug.
+	RejectEmptyRows bool
+
+	// DedupeKeyFunc optionally drops packed rows whose key was already packed since
+	// the box was last shipped or reset. All keys are held in memory until then, so
+	// prefer short keys for large loads, see s3box.Options.
+	DedupeKeyFunc func(row []byte) string
+
+	// DedupeConsecutive drops any packed row byte-identical to the row packed immediately
+	// before it. Only consecutive duplicates are dropped, see s3box.Options.
+	DedupeConsecutive bool
+
+	// OnRowPacked and OnRowsFlushed are optional hooks passed through to the
+	// underlying S3Box, see s3box.Options. They let consumers advance upstream
+	// offsets once rows are buffered or flushed to s3 respectively.
+	OnRowPacked   func(row []byte)
+	OnRowsFlushed func(count int)
+
+	// TeeWriter optionally receives a copy of every packed row as staged, newline included,
+	// e.g. a local file for reproducing issues offline. See s3box.Options.
+	TeeWriter io.Writer
+
+	// OnFlush is an optional hook passed through to the underlying S3Box,
+	// reporting the row count and compression ratio of each file uploaded to s3.
+	OnFlush func(s3box.FlushStats)
+
+	// MaxFilesBeforeShip optionally caps how many data files accumulate before a ship
+	// is recommended, bounding COPY time and the scope of recovering a failed load.
+	// Once reached, ShipRecommended reports true until the box ships or is reset.
+	//
+	// With AutoShip set, the Pack which reaches the limit also ships via ShipAndContinue.
+	// An auto-ship error is returned from that Pack, though its row remains packed and
+	// can still be shipped by calling Ship or ShipAndContinue. Like any Pack, one made
+	// while another ship is in progress fails with the shipping-in-progress error, so
+	// producers packing concurrently with an auto-ship must be prepared to retry.
+	MaxFilesBeforeShip int
+	AutoShip           bool
+
+	// UseManifest indicates whether data is COPYed via manifest files. Defaults to true.
+	//
+	// For very small loads, creating manifests is pure overhead. When set to false
+	// and at most maxDirectCopyFiles data files were generated, each file is instead
+	// COPYed directly from its s3 location. Larger loads still use manifests.
+	UseManifest *bool
+
+	// ContentMD5 uploads s3 files under 5MB with a Content-MD5 header, letting s3 reject
+	// corrupted uploads. Larger files use multipart uploads with per-part checksums.
+	ContentMD5 bool
+
+	// UploadRetries is the number of times a failed s3 upload is retried. Defaults to 0.
+	UploadRetries int
+
+	// MaxManifestRetries is the number of times a failed manifest upload is retried
+	// when shipping, in addition to its UploadRetries. Defaults to 0.
+	MaxManifestRetries int
+
+	// Backoff determines the delay before each retry, of both s3 uploads and connection
+	// failures starting a Redshift transaction, e.g. s3box.ConstantBackoff or s3box.LinearBackoff.
+	// Defaults to s3box.DefaultBackoff, an exponential backoff with jitter.
+	Backoff s3box.Backoff
+
+	// Debug stages data in s3 as uncompressed, newline-delimited JSON which is
+	// readable when debugging a failed load. Only use this for small debug loads.
+	Debug bool
+
+	// TimeFormat and DateFormat optionally override the TIMEFORMAT and DATEFORMAT
+	// used by the COPY, for sources with non-standard timestamp or date strings.
+	// TimeFormat defaults to 'auto', while DATEFORMAT is omitted unless provided.
+	// See http://docs.aws.amazon.com/redshift/latest/dg/r_DATEFORMAT_and_TIMEFORMAT_strings.html
+	TimeFormat string
+	DateFormat string
+
+	// SessionTimezone optionally sets the timezone for the load's transaction only,
+	// e.g. "America/New_York". Source timestamps without an explicit offset are
+	// interpreted in it. Defaults to the cluster's timezone, typically UTC.
+	SessionTimezone string
+
+	// SchemaOwner optionally sets the owner of the schema created by EnsureSchema,
+	// adding an AUTHORIZATION clause. Defaults to the connecting user.
+	SchemaOwner string
+
+	// StatUpdate and CompUpdate explicitly turn the COPY's STATUPDATE and COMPUPDATE
+	// ON or OFF. If nil they're omitted, leaving Redshift's defaults. On frequently
+	// loaded tables, turning these off avoids significant overhead.
+	StatUpdate *bool
+	CompUpdate *bool
+
+	// DestinationFunc optionally determines the destination schema and table at ship
+	// time, overriding Schema and Table. This lets a single box route to a destination
+	// computed from its data, e.g. per-customer tables. A returned error aborts the ship
+	// with the destination table left unchanged.
+	DestinationFunc func() (schema, table string, err error)
+
+	// LoadDate optionally sets the logical date of the load, used in the names of its
+	// manifests, so backfills are staged under the historical date they represent.
+	// Defaults to the time of shipping. It only dates the manifest slug: data files keep
+	// the s3box's timestamped keys, and no date-range DELETE is derived from it.
+	LoadDate time.Time
+
+	// WriteLoadMetadata writes a <slug>.meta.json object alongside the manifests of
+	// each load, recording its schema, table, file and row counts and timestamp for
+	// lineage tracking. Any Metadata, e.g. a git sha or job id, is recorded with it.
+	// It's written before the COPY, so a failed load may leave its record behind.
+	WriteLoadMetadata bool
+	Metadata          map[string]interface{}
+
 	// Truncate indicates if we should clear the destination table before
 	// transferring data. This is useful for tables representing snapshots
 	// of the world.
 	Truncate bool
 
-	// RedshiftConfiguration specifies the destination Redshift configuration
+	// ValidateBeforeLoad first runs each COPY with NOLOAD in a transaction which is rolled
+	// back, only proceeding to the real load if every COPY validates. Validation failures
+	// are returned as a *ValidationError, distinguishing them from failures of the load.
+	// This costs a second pass over the data in Redshift.
+	ValidateBeforeLoad bool
+
+	// PreCopySQL and PostCopySQL are optional statements run within the load's transaction,
+	// before the first COPY and after the last respectively, e.g. to disable a trigger or
+	// ANALYZE the table. A failing statement rolls back the whole load, like a failing COPY.
+	// Note some statements, such as VACUUM, can't run within a transaction.
+	PreCopySQL  []string
+	PostCopySQL []string
+
+	// ShipLimiter optionally bounds how many loads run at once across all boxes sharing it,
+	// queuing the rest, so simultaneous ships don't overwhelm the cluster's COPY concurrency.
+	ShipLimiter *ShipLimiter
+
+	// OnShipSuccess is an optional callback invoked once a ship's load has committed, e.g. to
+	// notify downstream consumers. QueryIDs are only included for ShipWithResult. It's called
+	// while shipping is still in progress, and any panic is recovered and logged.
+	OnShipSuccess func(ShipResult)
+
+	// RedshiftConfiguration specifies the destination Redshift configuration. If omitted,
+	// no connection is made and the box can only be shipped with PrepareManifests.
 	RedshiftConfiguration RedshiftConfiguration
 }
 
@@ -105,10 +464,58 @@ func newRedboxInjection(options Options, s3Box s3box.API, redshift *sql.DB) *Red
 // Errors occur if there's an invalid input or if there's
 // difficulty setting up either an s3 or redshift connection.
 func NewRedbox(options Options) (*Redbox, error) {
-	if options.Schema == "" || options.Table == "" || options.S3Bucket == "" {
-		return nil, errIncompleteArgs
+	options, err := resolveOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	redshift, err := redshiftConnection(options.RedshiftConfiguration)
+	if err != nil {
+		return nil, err
+	}
+	return newRedboxWithConnection(options, redshift)
+}
+
+// redshiftConnection opens the configured Redshift connection. Without a RedshiftConfiguration,
+// no connection is opened and nil is returned, leaving a box which can only PrepareManifests.
+func redshiftConnection(rc RedshiftConfiguration) (*sql.DB, error) {
+	if rc == (RedshiftConfiguration{}) {
+		return nil, nil
+	}
+	return rc.RedshiftConnection()
+}
+
+// resolveOptions validates the options and fills in their defaults, such as the bucket's region.
+func resolveOptions(options Options) (Options, error) {
+	if options.Schema == "" || options.Table == "" || (options.S3Bucket == "" && options.S3AccessPointARN == "" && options.Transport != TransportDirect) {
+		return options, errIncompleteArgs
+	}
+
+	if (options.CopyAWSKey == "") != (options.CopyAWSPassword == "") {
+		return options, errIncompleteCopyKeys
+	}
+	if options.CopyIAMRole != "" && options.CopyAWSKey != "" {
+		return options, errAmbiguousCopyCreds
+	}
+
+	if options.TimeFormat != "" && !validFormatString(options.TimeFormat) {
+		return options, errInvalidTimeFormat
+	}
+	if options.DateFormat != "" && !validFormatString(options.DateFormat) {
+		return options, errInvalidDateFormat
+	}
+
+	if options.SessionTimezone != "" && !timezonePattern.MatchString(options.SessionTimezone) {
+		return options, errInvalidTimezone
+	}
+
+	if options.Transport == TransportDirect {
+		return options, nil
 	}
 
+	// Only fall back to the environment for both or neither, so a dropped key or password is caught
+	if (options.AWSKey == "") != (options.AWSPassword == "") {
+		return options, errIncompleteAWSKeys
+	}
 	if options.AWSKey == "" {
 		options.AWSKey = os.Getenv("AWS_ACCESS_KEY_ID")
 	}
@@ -116,35 +523,141 @@ func NewRedbox(options Options) (*Redbox, error) {
 		options.AWSPassword = os.Getenv("AWS_SECRET_ACCESS_KEY")
 	}
 
+	// The access point stands in for the bucket, and determines the region
+	if options.S3AccessPointARN != "" {
+		s3Region, err := s3box.AccessPointRegion(options.S3AccessPointARN)
+		if err != nil {
+			return options, err
+		}
+		options.S3Bucket = options.S3AccessPointARN
+		options.S3Region = s3Region
+	}
 	if options.S3Region == "" {
-		s3Region, err := s3box.GetRegionForBucket(options.S3Bucket)
+		var s3Region string
+		var err error
+		if options.S3LookupRegion == "" {
+			s3Region, err = s3box.GetRegionForBucket(options.S3Bucket)
+		} else {
+			s3Region, err = s3box.GetRegionForBucketFrom(options.S3Bucket, options.S3LookupRegion)
+		}
 		if err != nil {
-			return nil, err
+			return options, err
 		}
 		options.S3Region = s3Region
 	}
 
-	s3Box, err := s3box.NewS3Box(s3box.Options{
-		S3Bucket:    options.S3Bucket,
-		S3Region:    options.S3Region,
-		AWSKey:      options.AWSKey,
-		AWSPassword: options.AWSPassword,
-		BufferSize:  options.BufferSize,
-	})
+	// Create the session up front, so boxes created by With share it
+	if options.AWSSession == nil {
+		options.AWSSession = session.New()
+	}
+	if options.BufferSize <= 0 {
+		options.BufferSize = s3box.DefaultBufferSize
+	}
+	if options.Backoff == nil {
+		options.Backoff = s3box.DefaultBackoff
+	}
+	if options.NumManifests <= 0 {
+		options.NumManifests = defaultNumManifests
+	}
+	return options, nil
+}
+
+// newRedboxWithConnection creates a Redbox with its own s3Box, given resolved options and a Redshift connection.
+func newRedboxWithConnection(options Options, redshift *sql.DB) (*Redbox, error) {
+	if options.Transport == TransportDirect {
+		return newRedboxInjection(options, &rowBuffer{}, redshift), nil
+	}
+
+	// The box is created after its s3Box, which must already be able to recommend ships to it
+	var rb *Redbox
+	s3Options := s3box.Options{
+		S3Bucket:                  options.S3Bucket,
+		S3AccessPointARN:          options.S3AccessPointARN,
+		S3Region:                  options.S3Region,
+		KeyPrefix:                 options.S3Prefix,
+		ShardID:                   options.ShardID,
+		RandomKeySuffix:           options.RandomKeySuffix,
+		Session:                   options.AWSSession,
+		VerifyWriteAccess:         options.VerifyWriteAccess,
+		AWSKey:                    options.AWSKey,
+		AWSPassword:               options.AWSPassword,
+		BufferSize:                options.BufferSize,
+		MaxRecordsPerFile:         options.MaxRecordsPerFile,
+		NumFiles:                  options.NumFiles,
+		FlushMode:                 options.FlushMode,
+		MandatoryFunc:             options.MandatoryFunc,
+		MaxFilesPerManifest:       options.MaxFilesPerManifest,
+		FilesPerManifest:          options.FilesPerManifest,
+		VerifyFilesBeforeManifest: options.VerifyFilesBeforeManifest,
+		VerifyManifestRoundtrip:   options.VerifyManifestRoundtrip,
+		VisibilityRetries:         options.VisibilityRetries,
+		DedupeKeyFunc:             options.DedupeKeyFunc,
+		DedupeConsecutive:         options.DedupeConsecutive,
+		OnRowPacked:               options.OnRowPacked,
+		TeeWriter:                 options.TeeWriter,
+		OnRowsFlushed:             options.OnRowsFlushed,
+		OnFlush:                   options.OnFlush,
+		MaxFilesBeforeShip:        options.MaxFilesBeforeShip,
+		ContentMD5:                options.ContentMD5,
+		UploadRetries:             options.UploadRetries,
+		MaxManifestRetries:        options.MaxManifestRetries,
+		Backoff:                   options.Backoff,
+		OnShipRecommended:         func(int) { rb.recommendShip() },
+		Debug:                     options.Debug,
+	}
+	var s3Box s3box.API
+	var err error
+	if options.BufferShards > 1 {
+		s3Box, err = s3box.NewShardedS3Box(s3Options, options.BufferShards)
+	} else {
+		s3Box, err = s3box.NewS3Box(s3Options)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	redshift, err := options.RedshiftConfiguration.RedshiftConnection()
+	rb = newRedboxInjection(options, s3Box, redshift)
+	return rb, nil
+}
+
+// Config returns a copy of the options the box is using, including any defaults
+// filled in during construction such as the resolved region, buffer size and
+// number of manifests. Note the options include credentials, so take care when logging them.
+func (rb *Redbox) Config() Options {
+	return rb.o
+}
+
+// CloneForTable creates a new Redbox with the same configuration, but targeting
+// the given schema and table. The clone reuses the already resolved region and
+// connection while keeping its own independent buffer and shipping state.
+func (rb *Redbox) CloneForTable(schema, table string) (*Redbox, error) {
+	return rb.With(func(options *Options) {
+		options.Schema = schema
+		options.Table = table
+	})
+}
+
+// With creates a new Redbox with the same configuration after applying the overrides,
+// e.g. a different table. The AWS session is shared, as is the Redshift connection
+// unless the overrides change the RedshiftConfiguration. Options
+// resolved during construction, such as the S3Region, are carried over, so clear or
+// override them alongside the options they derive from, e.g. the S3Bucket.
+// The new box keeps its own independent buffer and shipping state.
+func (rb *Redbox) With(overrides func(*Options)) (*Redbox, error) {
+	options := rb.o
+	overrides(&options)
+	options, err := resolveOptions(options)
 	if err != nil {
 		return nil, err
 	}
 
-	if options.NumManifests <= 0 {
-		options.NumManifests = defaultNumManifests
+	redshift := rb.redshift
+	if options.RedshiftConfiguration != rb.o.RedshiftConfiguration {
+		if redshift, err = redshiftConnection(options.RedshiftConfiguration); err != nil {
+			return nil, err
+		}
 	}
-
-	return newRedboxInjection(options, s3Box, redshift), nil
+	return newRedboxWithConnection(options, redshift)
 }
 
 // Pack writes a single row of bytes. Currently accepts JSON inputs.
@@ -161,7 +674,76 @@ func (rb *Redbox) Pack(row []byte) error {
 	if err := json.Unmarshal(row, &tempMap); err != nil {
 		return errInvalidJSONInput
 	}
-	return rb.s3Box.Pack(row)
+	if rb.o.RejectEmptyRows && len(tempMap) == 0 {
+		return ErrEmptyRow
+	}
+	if rb.o.RejectDuplicateKeys && hasDuplicateKey(row) {
+		return ErrDuplicateJSONKey
+	}
+	if rb.o.CompactJSON {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, row); err != nil {
+			return errInvalidJSONInput
+		}
+		row = compacted.Bytes()
+	}
+	if err := rb.s3Box.Pack(row); err != nil {
+		return err
+	}
+
+	// Auto-ship outside of the s3Box's Pack, which holds its lock
+	if rb.o.AutoShip && rb.ShipRecommended() {
+		if _, err := rb.ShipAndContinue(); err != nil && err != errShippingInProgress {
+			return fmt.Errorf("the row was packed, but auto-shipping failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// PackChannel packs each row received from the channel until it's closed or the context
+// is canceled, returning the number of rows packed. On the first error, whether from a Pack
+// or the context, it stops and returns the error, leaving any remaining rows in the channel
+// for the caller to drain.
+func (rb *Redbox) PackChannel(ctx context.Context, rows <-chan []byte) (int, error) {
+	packed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return packed, ctx.Err()
+		case row, ok := <-rows:
+			if !ok {
+				return packed, nil
+			}
+			if err := rb.Pack(row); err != nil {
+				return packed, err
+			}
+			packed++
+		}
+	}
+}
+
+// ShipRecommended indicates MaxFilesBeforeShip data files have accumulated
+// since the box was last shipped or reset.
+func (rb *Redbox) ShipRecommended() bool {
+	return atomic.LoadInt32(&rb.shipRecommended) == 1
+}
+
+// Flush uploads any buffered data to s3 without shipping. With the FlushReject
+// FlushMode, this must be called whenever Pack returns s3box.ErrBufferFull.
+func (rb *Redbox) Flush() error {
+	if rb.isShipped() {
+		return errBoxShipped
+	}
+	if rb.isShippingInProgress() {
+		return errShippingInProgress
+	}
+	return rb.s3Box.Flush()
+}
+
+// HasData indicates whether any data has been packed, letting callers
+// skip a Ship which would otherwise fail with nothing to ship.
+func (rb *Redbox) HasData() bool {
+	return rb.s3Box.HasData()
 }
 
 // Ship ships written data to the destination Redshift table.
@@ -169,6 +751,162 @@ func (rb *Redbox) Pack(row []byte) error {
 // Ship is transactional, meaning that any returned error means
 // the destination table has remained unchanged.
 func (rb *Redbox) Ship() ([]string, error) {
+	result, err := rb.ship(false, nil)
+	return result.Manifests, err
+}
+
+// ShipAndContinue ships written data like Ship, but then immediately readies the box
+// for further packing, as a Ship followed by a Reset would. The reset happens while
+// shipping is still in progress, so no pack can slip in between the two.
+func (rb *Redbox) ShipAndContinue() ([]string, error) {
+	result, err := rb.ship(true, nil)
+	return result.Manifests, err
+}
+
+// ShipWithResult ships like Ship, additionally returning the Redshift query id of each
+// COPY, for correlating a load with Redshift's system tables such as STL_LOAD_COMMITS.
+// The ids are looked up within the load's transaction, after each COPY.
+func (rb *Redbox) ShipWithResult() (ShipResult, error) {
+	var queryIDs []int64
+	result, err := rb.ship(false, &queryIDs)
+	if err != nil {
+		return ShipResult{}, err
+	}
+	result.QueryIDs = queryIDs
+	return result, nil
+}
+
+// ship ships written data, either sealing the box or resetting it for further packing.
+// The query ids of the COPYs are recorded into queryIDs, if provided.
+func (rb *Redbox) ship(continuePacking bool, queryIDs *[]int64) (ShipResult, error) {
+	if rb.isShipped() {
+		return ShipResult{}, errBoxShipped
+	}
+	if rb.isShippingInProgress() {
+		return ShipResult{}, errShippingInProgress
+	}
+
+	// Kick off the s3-to-Redshift job
+	rb.setShippingInProgress(true)
+	defer func() {
+		rb.setShippingInProgress(false)
+	}()
+
+	schema, table, err := rb.destination()
+	if err != nil {
+		return ShipResult{}, err
+	}
+
+	if buffer, ok := rb.s3Box.(*rowBuffer); ok {
+		rows := buffer.bufferedRows()
+		if len(rows) == 0 {
+			return ShipResult{}, errNothingToShip
+		}
+		if err := rb.insertToRedshift(schema, table, rows); err != nil {
+			return ShipResult{}, err
+		}
+		rb.finishShip(continuePacking)
+		result := ShipResult{Schema: schema, Table: table, Rows: len(rows)}
+		rb.notifyShipSuccess(result)
+		return result, nil
+	}
+
+	staged, err := rb.stage(schema, table)
+	if err != nil {
+		return ShipResult{}, err
+	}
+	if err := rb.commit(staged, queryIDs); err != nil {
+		return ShipResult{}, err
+	}
+
+	rb.finishShip(continuePacking)
+	result := shipResult(staged, queryIDs)
+	rb.notifyShipSuccess(result)
+	return result, nil
+}
+
+// shipResult describes the completed load of the staged data.
+func shipResult(staged StageResult, queryIDs *[]int64) ShipResult {
+	result := ShipResult{Schema: staged.Schema, Table: staged.Table, Manifests: staged.Manifests, Rows: staged.Rows}
+	if len(staged.Manifests) == 0 {
+		result.Manifests = staged.DataFiles
+	}
+	if queryIDs != nil {
+		result.QueryIDs = *queryIDs
+	}
+	return result
+}
+
+// notifyShipSuccess invokes any OnShipSuccess callback. Its panics are recovered and
+// logged, as the load has already committed.
+func (rb *Redbox) notifyShipSuccess(result ShipResult) {
+	if rb.o.OnShipSuccess == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("OnShipSuccess panicked after shipping into %s.%s: %v\n", result.Schema, result.Table, r)
+		}
+	}()
+	rb.o.OnShipSuccess(result)
+}
+
+// Stage is the first half of a two-phase ship, flushing written data to s3 and creating
+// its manifests without loading it into Redshift. The returned StageResult holds everything
+// Commit needs to complete the load, and can be serialized to commit from another process.
+// Like Ship, Stage seals the box.
+func (rb *Redbox) Stage() (StageResult, error) {
+	if rb.o.Transport == TransportDirect {
+		return StageResult{}, errNotSupportedByDirectTransport
+	}
+	if rb.isShipped() {
+		return StageResult{}, errBoxShipped
+	}
+	if rb.isShippingInProgress() {
+		return StageResult{}, errShippingInProgress
+	}
+
+	rb.setShippingInProgress(true)
+	defer func() {
+		rb.setShippingInProgress(false)
+	}()
+
+	schema, table, err := rb.destination()
+	if err != nil {
+		return StageResult{}, err
+	}
+	staged, err := rb.stage(schema, table)
+	if err != nil {
+		return StageResult{}, err
+	}
+	rb.finishShip(false)
+	return staged, nil
+}
+
+// Commit is the second half of a two-phase ship, loading data staged by Stage into
+// Redshift. It only relies on the box's configuration, so it may be called on a box
+// other than the one which staged the data, e.g. in another process. Like Ship, Commit
+// is transactional and returns the manifests COPYed from, or the data files if COPYed directly.
+func (rb *Redbox) Commit(staged StageResult) ([]string, error) {
+	if len(staged.Manifests) == 0 && len(staged.DataFiles) == 0 {
+		return nil, errNothingToShip
+	}
+	if err := rb.commit(staged, nil); err != nil {
+		return nil, err
+	}
+	result := shipResult(staged, nil)
+	rb.notifyShipSuccess(result)
+	return result.Manifests, nil
+}
+
+// PrepareManifests flushes written data to s3 and creates its manifests, returning their
+// keys without loading anything into Redshift, for users COPYing via their own orchestration.
+// Unlike Stage, manifests are always created. Like Ship, it seals the box. It's the only
+// way to ship a box created without a RedshiftConfiguration, which has no connection.
+func (rb *Redbox) PrepareManifests() ([]string, error) {
+	if rb.o.Transport == TransportDirect {
+		return nil, errNotSupportedByDirectTransport
+	}
 	if rb.isShipped() {
 		return nil, errBoxShipped
 	}
@@ -176,68 +914,503 @@ func (rb *Redbox) Ship() ([]string, error) {
 		return nil, errShippingInProgress
 	}
 
-	// Kick off the s3-to-Redshift job
 	rb.setShippingInProgress(true)
 	defer func() {
 		rb.setShippingInProgress(false)
 	}()
 
-	manifests, err := rb.s3Box.CreateManifests(rb.manifestSlug(), rb.o.NumManifests)
+	schema, table, err := rb.destination()
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := rb.s3Box.CreateManifests(rb.manifestSlug(schema, table), rb.o.NumManifests)
 	if err != nil {
 		return nil, err
 	}
 	if len(manifests) == 0 { // If no data was written, there's nothing to ship.
 		return nil, errNothingToShip
 	}
-
-	if err := rb.copyToRedshift(manifests); err != nil {
+	if err := rb.writeLoadMetadata(schema, table); err != nil {
 		return nil, err
 	}
+	rb.finishShip(false)
+	return manifests, nil
+}
+
+// stage flushes written data to s3, creating manifests unless the data files are
+// to be COPYed directly, and writes any load metadata.
+func (rb *Redbox) stage(schema, table string) (StageResult, error) {
+	staged := StageResult{Schema: schema, Table: table}
+	if !rb.useManifest() {
+		files, err := rb.s3Box.DataFiles()
+		if err != nil {
+			return StageResult{}, err
+		}
+		if len(files) == 0 { // If no data was written, there's nothing to ship.
+			return StageResult{}, errNothingToShip
+		}
+		if len(files) <= maxDirectCopyFiles {
+			staged.DataFiles = files
+		}
+	}
+
+	if staged.DataFiles == nil {
+		manifests, err := rb.s3Box.CreateManifests(rb.manifestSlug(schema, table), rb.o.NumManifests)
+		if err != nil {
+			return StageResult{}, err
+		}
+		if len(manifests) == 0 { // If no data was written, there's nothing to ship.
+			return StageResult{}, errNothingToShip
+		}
+		staged.Manifests = manifests
+	}
+	if err := rb.writeLoadMetadata(schema, table); err != nil {
+		return StageResult{}, err
+	}
+
+	staged.Rows = rb.s3Box.Stats().Rows
+	return staged, nil
+}
+
+// commit COPYs the staged manifests, or data files, into the staged destination,
+// recording the query ids of the COPYs into queryIDs if provided.
+func (rb *Redbox) commit(staged StageResult, queryIDs *[]int64) error {
+	var copyStmts []string
+	for _, manifest := range staged.Manifests {
+		copyStmts = append(copyStmts, rb.copyStatement(staged.Schema, staged.Table, manifest))
+	}
+	for _, file := range staged.DataFiles {
+		copyStmts = append(copyStmts, rb.directCopyStatement(staged.Schema, staged.Table, file))
+	}
+	return rb.copyToRedshift(staged.Schema, staged.Table, copyStmts, queryIDs)
+}
+
+// Plan previews everything a Ship would do without executing it: the manifests,
+// the COPY statements with credentials redacted, the DELETE when truncating, and
+// the number of files and rows. Buffered data is flushed to s3 so the plan is
+// accurate, but no manifests are written and the box isn't shipped.
+func (rb *Redbox) Plan() (ShipPlan, error) {
+	if rb.o.Transport == TransportDirect {
+		return ShipPlan{}, errNotSupportedByDirectTransport
+	}
+	if rb.isShipped() {
+		return ShipPlan{}, errBoxShipped
+	}
+	if rb.isShippingInProgress() {
+		return ShipPlan{}, errShippingInProgress
+	}
+
+	schema, table, err := rb.destination()
+	if err != nil {
+		return ShipPlan{}, err
+	}
+	files, err := rb.s3Box.DataFiles()
+	if err != nil {
+		return ShipPlan{}, err
+	}
+	if len(files) == 0 {
+		return ShipPlan{}, errNothingToShip
+	}
+
+	plan := ShipPlan{
+		Schema:    schema,
+		Table:     table,
+		DataFiles: files,
+		Rows:      rb.s3Box.Stats().Rows,
+	}
+	if rb.o.Truncate {
+		plan.DeleteStatement = deleteStatement(schema, table)
+	}
+
+	if !rb.useManifest() && len(files) <= maxDirectCopyFiles {
+		for _, file := range files {
+			plan.CopyStatements = append(plan.CopyStatements, rb.directCopyStatement(schema, table, file))
+		}
+	} else {
+		plan.Manifests, err = rb.s3Box.PlanManifests(rb.manifestSlug(schema, table), rb.o.NumManifests)
+		if err != nil {
+			return ShipPlan{}, err
+		}
+		for _, manifest := range plan.Manifests {
+			plan.CopyStatements = append(plan.CopyStatements, rb.copyStatement(schema, table, manifest))
+		}
+	}
+
+	credentials := rb.copyCredentials()
+	for i, copyStmt := range plan.CopyStatements {
+		plan.CopyStatements[i] = strings.Replace(copyStmt, credentials, redactedCredentials, 1)
+	}
+	return plan, nil
+}
+
+// finishShip either marks the box as shipped or resets it for further packing.
+func (rb *Redbox) finishShip(continuePacking bool) {
+	atomic.StoreInt32(&rb.shipRecommended, 0)
 
+	if continuePacking {
+		rb.s3Box.Reset()
+		return
+	}
 	rb.markShipped()
-	return manifests, nil
 }
 
-// manifestSlug defines a convention for the slug of each manifest file.
-func (rb *Redbox) manifestSlug() string {
-	return fmt.Sprintf("%s_%s_%s", rb.o.Schema, rb.o.Table, time.Now().Format(time.RFC3339))
+// destination resolves the schema and table to load into, consulting the DestinationFunc if provided.
+func (rb *Redbox) destination() (string, string, error) {
+	if rb.o.DestinationFunc == nil {
+		return rb.o.Schema, rb.o.Table, nil
+	}
+	schema, table, err := rb.o.DestinationFunc()
+	if err != nil {
+		return "", "", fmt.Errorf("failed resolving the destination table: %s", err)
+	}
+	if schema == "" || table == "" {
+		return "", "", errIncompleteDestination
+	}
+	return schema, table, nil
 }
 
-// copyToRedshift transports data pointed to by the manifests into Redshift.
-// If the truncate flag is present the destination table is first cleared.
-func (rb *Redbox) copyToRedshift(manifests []string) error {
-	tx, err := rb.redshift.Begin()
+// useManifest reports whether COPYs should go through manifest files.
+func (rb *Redbox) useManifest() bool {
+	return rb.o.UseManifest == nil || *rb.o.UseManifest
+}
+
+// PingRedshift verifies the Redshift connection is alive, establishing one if needed,
+// e.g. for health checks of long-lived services. No load is attempted.
+func (rb *Redbox) PingRedshift(ctx context.Context) error {
+	if rb.redshift == nil {
+		return errNoRedshiftConnection
+	}
+	return rb.redshift.PingContext(ctx)
+}
+
+// EnsureSchema creates the destination schema, owned by any SchemaOwner, unless it already exists.
+func (rb *Redbox) EnsureSchema() error {
+	tx, err := rb.begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(createSchemaStatement(rb.o.Schema, rb.o.SchemaOwner)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reset readies a box for a new load, allowing packing to resume after a Ship.
+// Any data packed but not yet shipped is discarded. Reset errors if shipping is in progress.
+func (rb *Redbox) Reset() error {
+	rb.mt.Lock()
+	defer rb.mt.Unlock()
+	if rb.shippingInProgress {
+		return errShippingInProgress
+	}
+	rb.s3Box.Reset()
+	rb.shipped = false
+	atomic.StoreInt32(&rb.shipRecommended, 0)
+	return nil
+}
+
+// manifestSlug defines a convention for the slug of each manifest file, dated by the LoadDate.
+func (rb *Redbox) manifestSlug(schema, table string) string {
+	loadDate := rb.o.LoadDate
+	if loadDate.IsZero() {
+		loadDate = time.Now()
+	}
+	return fmt.Sprintf("%s_%s_%s", schema, table, loadDate.Format(time.RFC3339))
+}
+
+// writeLoadMetadata writes the load's metadata record when WriteLoadMetadata is set.
+func (rb *Redbox) writeLoadMetadata(schema, table string) error {
+	if !rb.o.WriteLoadMetadata {
+		return nil
+	}
+	metadata := make(map[string]interface{}, len(rb.o.Metadata)+3)
+	for key, value := range rb.o.Metadata {
+		metadata[key] = value
+	}
+	metadata["schema"] = schema
+	metadata["table"] = table
+	metadata["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+	_, err := rb.s3Box.WriteMetadata(rb.manifestSlug(schema, table), metadata)
+	return err
+}
+
+// copyToRedshift runs the given COPY statements in a single transaction, surrounded
+// by any PreCopySQL and PostCopySQL. If the truncate flag is present the destination
+// table is first cleared. With ValidateBeforeLoad, the COPYs are first validated.
+// The query id of each COPY is recorded into queryIDs, if provided.
+func (rb *Redbox) copyToRedshift(schema, table string, copyStmts []string, queryIDs *[]int64) error {
+	if rb.o.ValidateBeforeLoad {
+		if err := rb.validateCopies(copyStmts); err != nil {
+			return err
+		}
+	}
+	return rb.loadToRedshift(schema, table, func(tx *sql.Tx) error {
+		var ids []int64 // Rebuilt on every attempt, in case the load is retried
+		for _, copyStmt := range copyStmts {
+			if _, err := tx.Exec(copyStmt); err != nil {
+				return err
+			}
+			if queryIDs != nil {
+				var id int64
+				if err := tx.QueryRow(lastCopyIDQuery).Scan(&id); err != nil {
+					return err
+				}
+				ids = append(ids, id)
+			}
+		}
+		if queryIDs != nil {
+			*queryIDs = ids
+		}
+		return nil
+	})
+}
+
+// validateCopies runs each COPY statement with NOLOAD in a transaction which is always
+// rolled back, checking the data files parse without loading them. Any failure is
+// returned as a ValidationError.
+func (rb *Redbox) validateCopies(copyStmts []string) error {
+	release := rb.acquireShipSlot()
+	defer release()
+	tx, err := rb.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := rb.setSessionTimezone(tx); err != nil {
+		return err
+	}
+	for _, copyStmt := range copyStmts {
+		if _, err := tx.Exec(copyStmt + " NOLOAD"); err != nil {
+			return &ValidationError{Err: err}
+		}
+	}
+	return nil
+}
+
+// loadToRedshift runs the given load in a single transaction, retrying the whole transaction
+// on lock contention up to the configured number of LockRetries. A transaction failing on a
+// bad connection, e.g. one Redshift dropped while idle during a long pack, is retried once.
+func (rb *Redbox) loadToRedshift(schema, table string, load func(tx *sql.Tx) error) error {
+	err := rb.loadOnce(schema, table, load)
+	for retry := 1; err != nil && isLockError(err) && retry <= rb.o.RedshiftConfiguration.LockRetries; retry++ {
+		delay := rb.backoff().NextDelay(retry)
+		log.Printf("Load into %s.%s failed on lock contention, retrying in %s (%d/%d): %s\n", schema, table, delay, retry, rb.o.RedshiftConfiguration.LockRetries, err)
+		time.Sleep(delay)
+		err = rb.loadOnce(schema, table, load)
+	}
+	return err
+}
+
+// loadOnce runs the given load in a single transaction and commits it. A transaction
+// failing on a bad connection before its commit is retried once on a fresh connection,
+// as the pool can't retry statements within a transaction. A failed commit is never
+// retried, since the server may have committed before the connection dropped.
+func (rb *Redbox) loadOnce(schema, table string, load func(tx *sql.Tx) error) error {
+	release := rb.acquireShipSlot()
+	defer release()
+	tx, err := rb.prepareLoad(schema, table, load)
+	if err == driver.ErrBadConn {
+		log.Printf("Load into %s.%s failed on a bad connection, retrying on a fresh one: %s\n", schema, table, err)
+		tx, err = rb.prepareLoad(schema, table, load)
+	}
 	if err != nil {
 		return err
 	}
+	return tx.Commit()
+}
+
+// prepareLoad runs the given load in a new transaction, surrounded by any PreCopySQL
+// and PostCopySQL, returning the transaction ready to commit. If the truncate flag is
+// present the destination table is first cleared. The transaction starts by setting
+// any SessionTimezone. Any error rolls back the transaction.
+func (rb *Redbox) prepareLoad(schema, table string, load func(tx *sql.Tx) error) (*sql.Tx, error) {
+	tx, err := rb.begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rb.setSessionTimezone(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	if rb.o.Truncate {
-		delStmt := fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", rb.o.Schema, rb.o.Table)
-		if _, err := tx.Exec(delStmt); err != nil {
+		if _, err := tx.Exec(deleteStatement(schema, table)); err != nil {
 			tx.Rollback()
-			return err
+			return nil, err
 		}
 	}
 
-	for _, manifest := range manifests {
-		copyStmt := rb.copyStatement(manifest)
-		if _, err := tx.Exec(copyStmt); err != nil {
+	for _, stmt := range rb.o.PreCopySQL {
+		if _, err := tx.Exec(stmt); err != nil {
 			tx.Rollback()
-			return err
+			return nil, err
+		}
+	}
+	if err := load(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, stmt := range rb.o.PostCopySQL {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return nil, err
 		}
 	}
 
-	return tx.Commit()
+	return tx, nil
+}
+
+// acquireShipSlot waits for a slot of any ShipLimiter, returning the function releasing it.
+func (rb *Redbox) acquireShipSlot() func() {
+	if rb.o.ShipLimiter == nil {
+		return func() {}
+	}
+	return rb.o.ShipLimiter.acquire()
+}
+
+// setSessionTimezone sets the SessionTimezone for the rest of the transaction, if configured.
+// SET LOCAL keeps the setting from outliving the transaction on the pooled connection.
+func (rb *Redbox) setSessionTimezone(tx *sql.Tx) error {
+	if rb.o.SessionTimezone == "" {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf("SET LOCAL timezone TO '%s'", rb.o.SessionTimezone))
+	return err
+}
+
+// begin starts a Redshift transaction, retrying connection errors
+// up to the configured number of ConnectRetries, waiting as determined by the Backoff.
+func (rb *Redbox) begin() (*sql.Tx, error) {
+	if rb.redshift == nil {
+		return nil, errNoRedshiftConnection
+	}
+	tx, err := rb.redshift.Begin()
+	for retry := 1; err != nil && isConnectionError(err) && retry <= rb.o.RedshiftConfiguration.ConnectRetries; retry++ {
+		delay := rb.backoff().NextDelay(retry)
+		log.Printf("Failed connecting to Redshift, retrying in %s (%d/%d): %s\n", delay, retry, rb.o.RedshiftConfiguration.ConnectRetries, err)
+		time.Sleep(delay)
+		tx, err = rb.redshift.Begin()
+	}
+	return tx, err
+}
+
+// backoff returns the configured Backoff, which is unset for boxes not created via NewRedbox.
+func (rb *Redbox) backoff() s3box.Backoff {
+	if rb.o.Backoff == nil {
+		return s3box.DefaultBackoff
+	}
+	return rb.o.Backoff
+}
+
+// createSchemaStatement generates the statement creating the given schema if it doesn't exist.
+func createSchemaStatement(schema, owner string) string {
+	stmt := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quoteIdentifier(schema))
+	if owner != "" {
+		stmt += fmt.Sprintf(" AUTHORIZATION %s", quoteIdentifier(owner))
+	}
+	return stmt
+}
+
+// deleteStatement generates the DELETE clearing the destination table when truncating.
+func deleteStatement(schema, table string) string {
+	return fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", schema, table)
 }
 
 // copyStatment generates the COPY statement for the given manifest and Redbox configuration
-func (rb *Redbox) copyStatement(manifest string) string {
+func (rb *Redbox) copyStatement(schema, table, manifest string) string {
 	manifestURL := fmt.Sprintf("s3://%s/%s", rb.o.S3Bucket, manifest)
-	copy := fmt.Sprintf("COPY \"%s\".\"%s\" FROM '%s' MANIFEST REGION '%s'", rb.o.Schema, rb.o.Table, manifestURL, rb.o.S3Region)
+	return rb.copyStatementFrom(schema, table, manifestURL, true)
+}
+
+// directCopyStatement generates the COPY statement loading a single data file, bypassing manifests.
+func (rb *Redbox) directCopyStatement(schema, table, fileURL string) string {
+	return rb.copyStatementFrom(schema, table, fileURL, false)
+}
+
+// copyStatementFrom generates the COPY statement for the given s3 source.
+func (rb *Redbox) copyStatementFrom(schema, table, sourceURL string, manifest bool) string {
+	copy := fmt.Sprintf("COPY \"%s\".\"%s\" FROM '%s'", schema, table, sourceURL)
+	if manifest {
+		copy += " MANIFEST"
+	}
+	// An access point ARN already determines the region
+	if rb.o.S3AccessPointARN == "" {
+		copy += fmt.Sprintf(" REGION '%s'", rb.o.S3Region)
+	}
 	dataFormat := "GZIP JSON 'auto'"
-	options := "TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON COMPUPDATE ON"
-	creds := fmt.Sprintf("CREDENTIALS 'aws_access_key_id=%s;aws_secret_access_key=%s'", rb.o.AWSKey, rb.o.AWSPassword)
-	return fmt.Sprintf("%s %s %s %s", copy, dataFormat, options, creds)
+	if rb.o.Debug {
+		dataFormat = "JSON 'auto'"
+	}
+	timeFormat := "auto"
+	if rb.o.TimeFormat != "" {
+		timeFormat = rb.o.TimeFormat
+	}
+	options := fmt.Sprintf("TIMEFORMAT '%s'", timeFormat)
+	if rb.o.DateFormat != "" {
+		options += fmt.Sprintf(" DATEFORMAT '%s'", rb.o.DateFormat)
+	}
+	options += " TRUNCATECOLUMNS"
+	if rb.o.StatUpdate != nil {
+		options += " STATUPDATE " + onOff(*rb.o.StatUpdate)
+	}
+	if rb.o.CompUpdate != nil {
+		options += " COMPUPDATE " + onOff(*rb.o.CompUpdate)
+	}
+	return fmt.Sprintf("%s %s %s %s", copy, dataFormat, options, rb.copyCredentials())
+}
+
+// onOff formats a boolean COPY parameter.
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// hasDuplicateKey reports whether the JSON object repeats a top-level key.
+// Nested objects aren't checked. The row must already be known to be a valid object.
+func hasDuplicateKey(row []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(row))
+	if _, err := decoder.Token(); err != nil { // The opening brace
+		return false
+	}
+	keys := map[string]struct{}{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		key, _ := token.(string)
+		if _, seen := keys[key]; seen {
+			return true
+		}
+		keys[key] = struct{}{}
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// validFormatString checks a TIMEFORMAT or DATEFORMAT string can safely be embedded in a COPY.
+func validFormatString(format string) bool {
+	return strings.TrimSpace(format) != "" && !strings.Contains(format, "'")
+}
+
+// copyCredentials generates the CREDENTIALS clause Redshift uses to read from s3 during a COPY.
+func (rb *Redbox) copyCredentials() string {
+	switch {
+	case rb.o.CopyIAMRole != "":
+		return fmt.Sprintf("CREDENTIALS 'aws_iam_role=%s'", rb.o.CopyIAMRole)
+	case rb.o.CopyAWSKey != "":
+		return fmt.Sprintf("CREDENTIALS 'aws_access_key_id=%s;aws_secret_access_key=%s'", rb.o.CopyAWSKey, rb.o.CopyAWSPassword)
+	default:
+		return fmt.Sprintf("CREDENTIALS 'aws_access_key_id=%s;aws_secret_access_key=%s'", rb.o.AWSKey, rb.o.AWSPassword)
+	}
 }
 
 func (rb *Redbox) setShippingInProgress(inProgress bool) {
@@ -252,6 +1425,11 @@ func (rb *Redbox) markShipped() {
 	rb.shipped = true
 }
 
+// recommendShip records that enough data files have accumulated to warrant a ship.
+func (rb *Redbox) recommendShip() {
+	atomic.StoreInt32(&rb.shipRecommended, 1)
+}
+
 // isShippingInProgress exposes whether a send is in progress.
 func (rb *Redbox) isShippingInProgress() bool {
 	rb.mt.Lock()
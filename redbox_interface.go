@@ -4,4 +4,6 @@ package redbox
 type API interface {
 	Pack(data []byte) error
 	Ship() ([]string, error)
+	ShipAndContinue() ([]string, error)
+	Reset() error
 }
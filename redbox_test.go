@@ -1,11 +1,18 @@
 package redbox
 
 import (
+	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"net"
+	"regexp"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Clever/pq"
+	"github.com/cgclever/redbox/s3box"
 	"github.com/stretchr/testify/assert"
 
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
@@ -19,6 +26,7 @@ var (
 	awsKey           = "key"
 	awsPassword      = "secret"
 	testManifestSlug = "slug"
+	testNumDataFiles = 3
 
 	testOptions = Options{
 		Schema:      schema,
@@ -27,13 +35,22 @@ var (
 		S3Region:    s3Region,
 		AWSKey:      awsKey,
 		AWSPassword: awsPassword,
+		RedshiftConfiguration: RedshiftConfiguration{
+			Host: "localhost",
+			Port: "5439",
+		},
 	}
 )
 
 type MockSuccessS3Box struct {
+	packed   bool
+	rows     int
+	metadata map[string]interface{}
 }
 
 func (m *MockSuccessS3Box) Pack(data []byte) error {
+	m.packed = true
+	m.rows++
 	return nil
 }
 
@@ -46,6 +63,36 @@ func (m *MockSuccessS3Box) CreateManifests(manifestSlug string, nManifests int)
 	return manifests, nil
 }
 
+func (m *MockSuccessS3Box) PlanManifests(manifestSlug string, nManifests int) ([]string, error) {
+	return m.CreateManifests(manifestSlug, nManifests)
+}
+
+func (m *MockSuccessS3Box) WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error) {
+	m.metadata = metadata
+	return manifestSlug + ".meta.json", nil
+}
+
+func (m *MockSuccessS3Box) Stats() s3box.Stats {
+	return s3box.Stats{Files: testNumDataFiles, Rows: m.rows}
+}
+
+func (m *MockSuccessS3Box) Flush() error {
+	return nil
+}
+
+func (m *MockSuccessS3Box) DataFiles() ([]string, error) {
+	return mockDataFiles(), nil
+}
+
+func (m *MockSuccessS3Box) HasData() bool {
+	return m.packed
+}
+
+func (m *MockSuccessS3Box) Reset() {
+	m.packed = false
+	m.rows = 0
+}
+
 type MockSlowS3Box struct {
 }
 
@@ -64,6 +111,92 @@ func (m *MockSlowS3Box) CreateManifests(manifestSlug string, nManifests int) ([]
 	return manifests, nil
 }
 
+func (m *MockSlowS3Box) PlanManifests(manifestSlug string, nManifests int) ([]string, error) {
+	return m.CreateManifests(manifestSlug, nManifests)
+}
+
+func (m *MockSlowS3Box) WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error) {
+	return manifestSlug + ".meta.json", nil
+}
+
+func (m *MockSlowS3Box) Stats() s3box.Stats {
+	return s3box.Stats{Files: testNumDataFiles}
+}
+
+func (m *MockSlowS3Box) Flush() error {
+	return nil
+}
+
+func (m *MockSlowS3Box) DataFiles() ([]string, error) {
+	time.Sleep(100 * time.Millisecond)
+	return mockDataFiles(), nil
+}
+
+func (m *MockSlowS3Box) HasData() bool {
+	return true
+}
+
+func (m *MockSlowS3Box) Reset() {
+}
+
+// MockRecordingS3Box records the rows packed into each load.
+type MockRecordingS3Box struct {
+	rows    []string
+	batches [][]string
+}
+
+func (m *MockRecordingS3Box) Pack(data []byte) error {
+	m.rows = append(m.rows, string(data))
+	return nil
+}
+
+func (m *MockRecordingS3Box) CreateManifests(manifestSlug string, nManifests int) ([]string, error) {
+	if len(m.rows) == 0 {
+		return nil, nil
+	}
+	m.batches = append(m.batches, m.rows)
+	return []string{fmt.Sprintf("%s_0.manifest", testManifestSlug)}, nil
+}
+
+func (m *MockRecordingS3Box) PlanManifests(manifestSlug string, nManifests int) ([]string, error) {
+	if len(m.rows) == 0 {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("%s_0.manifest", testManifestSlug)}, nil
+}
+
+func (m *MockRecordingS3Box) WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error) {
+	return manifestSlug + ".meta.json", nil
+}
+
+func (m *MockRecordingS3Box) Stats() s3box.Stats {
+	return s3box.Stats{Files: testNumDataFiles, Rows: len(m.rows)}
+}
+
+func (m *MockRecordingS3Box) Flush() error {
+	return nil
+}
+
+func (m *MockRecordingS3Box) DataFiles() ([]string, error) {
+	return mockDataFiles(), nil
+}
+
+func (m *MockRecordingS3Box) HasData() bool {
+	return len(m.rows) > 0
+}
+
+func (m *MockRecordingS3Box) Reset() {
+	m.rows = nil
+}
+
+func mockDataFiles() []string {
+	var files []string
+	for i := 0; i < testNumDataFiles; i++ {
+		files = append(files, fmt.Sprintf("s3://%s/%s_%d.gz", s3Bucket, testManifestSlug, i))
+	}
+	return files
+}
+
 func TestSuccessfulJSONPack(t *testing.T) {
 	assert := assert.New(t)
 	s3Box := &MockSuccessS3Box{}
@@ -106,7 +239,7 @@ func TestCorrectDBCallsOnSendWithTruncate(t *testing.T) {
 	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
 	assert.NoError(err)
 	for _, manifest := range manifests {
-		copyStmt := redbox.copyStatement(manifest)
+		copyStmt := redbox.copyStatement(schema, table, manifest)
 		mock.ExpectExec(copyStmt).WillReturnResult(sqlmock.NewResult(1, 1))
 	}
 
@@ -133,7 +266,7 @@ func TestCorrectDBCallsOnSendWithoutTruncate(t *testing.T) {
 	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
 	assert.NoError(err)
 	for _, manifest := range manifests {
-		copyStmt := redbox.copyStatement(manifest)
+		copyStmt := redbox.copyStatement(schema, table, manifest)
 		mock.ExpectExec(copyStmt).WillReturnResult(sqlmock.NewResult(1, 1))
 	}
 	mock.ExpectCommit()
@@ -160,7 +293,7 @@ func TestRollbackOnError(t *testing.T) {
 	assert.NoError(err)
 
 	copyErr := fmt.Errorf("Some COPY Error")
-	copyStmt := redbox.copyStatement(manifests[0])
+	copyStmt := redbox.copyStatement(schema, table, manifests[0])
 	mock.ExpectExec(copyStmt).WillReturnError(copyErr)
 	mock.ExpectRollback()
 
@@ -200,7 +333,7 @@ func TestNoActionsAllowedDuringOrAfterSuccessfulSend(t *testing.T) {
 	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
 	assert.NoError(err)
 	for _, manifest := range manifests {
-		copyStmt := redbox.copyStatement(manifest)
+		copyStmt := redbox.copyStatement(schema, table, manifest)
 		mock.ExpectExec(copyStmt).WillReturnResult(sqlmock.NewResult(1, 1))
 	}
 	mock.ExpectCommit()
@@ -227,3 +360,1266 @@ func TestNoActionsAllowedDuringOrAfterSuccessfulSend(t *testing.T) {
 
 	assert.NoError(mock.ExpectationsWereMet())
 }
+
+func TestCorrectDBCallsOnSendWithoutManifests(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	useManifest := false
+	options := testOptions
+	options.UseManifest = &useManifest
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	// Set expected commands for mocked SQL client
+	mock.ExpectBegin()
+	files, err := s3Box.DataFiles()
+	assert.NoError(err)
+	for _, file := range files {
+		copyStmt := redbox.directCopyStatement(schema, table, file)
+		mock.ExpectExec(regexp.QuoteMeta(copyStmt)).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	// Run Send and assert each file was COPYed directly
+	shippedFiles, err := redbox.Ship()
+	assert.NoError(err)
+	assert.Equal(shippedFiles, files)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDirectCopyStatementOmitsManifest(t *testing.T) {
+	assert := assert.New(t)
+	redbox := newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+
+	fileURL := fmt.Sprintf("s3://%s/%s_0.gz", s3Bucket, testManifestSlug)
+	copyStmt := redbox.directCopyStatement(schema, table, fileURL)
+	assert.Equal(fmt.Sprintf("COPY \"%s\".\"%s\" FROM '%s' REGION '%s' GZIP JSON 'auto' "+
+		"TIMEFORMAT 'auto' TRUNCATECOLUMNS "+
+		"CREDENTIALS 'aws_access_key_id=%s;aws_secret_access_key=%s'",
+		schema, table, fileURL, s3Region, awsKey, awsPassword), copyStmt)
+	assert.NotContains(copyStmt, "MANIFEST")
+
+	manifestStmt := redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(manifestStmt, fmt.Sprintf("FROM 's3://%s/%s' MANIFEST REGION '%s'", s3Bucket, testManifestSlug, s3Region))
+}
+
+func TestClonedBoxesPackIndependently(t *testing.T) {
+	assert := assert.New(t)
+	redbox, err := NewRedbox(testOptions)
+	assert.NoError(err)
+
+	clone1, err := redbox.CloneForTable("schema1", "table1")
+	assert.NoError(err)
+	clone2, err := redbox.CloneForTable("schema2", "table2")
+	assert.NoError(err)
+
+	// Options are copied with only the destination overridden
+	assert.Equal("schema1", clone1.o.Schema)
+	assert.Equal("table1", clone1.o.Table)
+	assert.Equal("schema2", clone2.o.Schema)
+	assert.Equal("table2", clone2.o.Table)
+	assert.Equal(redbox.o.S3Region, clone1.o.S3Region)
+	assert.Equal(schema, redbox.o.Schema)
+	assert.Equal(table, redbox.o.Table)
+
+	// Each clone manages its own data and shipping state
+	assert.True(clone1.s3Box != clone2.s3Box)
+	assert.True(clone1.s3Box != redbox.s3Box)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(clone1.Pack(data))
+	clone1.markShipped()
+	assert.Equal(clone1.Pack(data), errBoxShipped)
+	assert.NoError(clone2.Pack(data))
+	assert.NoError(redbox.Pack(data))
+}
+
+func TestS3AccessPointARN(t *testing.T) {
+	assert := assert.New(t)
+	arn := "arn:aws:s3:us-west-2:123456789012:accesspoint/loads"
+	options := testOptions
+	options.S3Bucket = ""
+	options.S3Region = ""
+	options.S3AccessPointARN = arn
+	resolved, err := resolveOptions(options)
+	assert.NoError(err)
+	assert.Equal(arn, resolved.S3Bucket)
+	assert.Equal("us-west-2", resolved.S3Region)
+
+	// The COPY reads the manifest through the access point, without a REGION clause
+	redbox := newRedboxInjection(resolved, &MockSuccessS3Box{}, nil)
+	copyStmt := redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(copyStmt, fmt.Sprintf("FROM 's3://%s/%s' MANIFEST GZIP", arn, testManifestSlug))
+	assert.NotContains(copyStmt, "REGION")
+
+	options.S3AccessPointARN = "arn:aws:s3:::loads"
+	_, err = resolveOptions(options)
+	assert.Error(err)
+}
+
+func TestRetryConnectionErrorsOnBegin(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	options.RedshiftConfiguration.ConnectRetries = 2
+	options.Backoff = s3box.ConstantBackoff(time.Millisecond)
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	// The cluster is unreachable at first, then succeeds
+	connErr := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	mock.ExpectBegin().WillReturnError(connErr)
+	mock.ExpectBegin()
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+	mock.ExpectExec(redbox.copyStatement(schema, table, manifests[0])).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	shippedManifests, err := redbox.Ship()
+	assert.NoError(err)
+	assert.Equal(manifests, shippedManifests)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRetryBadConnection(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	redbox := newRedboxInjection(options, s3Box, redshift)
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+	copyStmt := redbox.copyStatement(schema, table, manifests[0])
+
+	// The mock only allows reconnecting while another of its connections remains open
+	held, err := redshift.Conn(context.Background())
+	assert.NoError(err)
+	defer held.Close()
+
+	// A connection dropped mid-transaction fails the COPY, after which the
+	// transaction is retried once on a fresh connection without any ConnectRetries
+	mock.ExpectBegin()
+	mock.ExpectExec(copyStmt).WillReturnError(driver.ErrBadConn)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec(copyStmt).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	shippedManifests, err := redbox.Ship()
+	assert.NoError(err)
+	assert.Equal(manifests, shippedManifests)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNoRetryOnCommitBadConnection(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	redbox := newRedboxInjection(options, s3Box, redshift)
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+
+	// The server may have committed before the connection dropped, so retrying could load twice
+	mock.ExpectBegin()
+	mock.ExpectExec(redbox.copyStatement(schema, table, manifests[0])).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit().WillReturnError(driver.ErrBadConn)
+
+	_, err = redbox.Ship()
+	assert.Equal(driver.ErrBadConn, err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNoRetryOnNonConnectionErrors(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	options.RedshiftConfiguration.ConnectRetries = 2
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	beginErr := fmt.Errorf("permission denied")
+	mock.ExpectBegin().WillReturnError(beginErr)
+
+	_, err = redbox.Ship()
+	assert.Equal(beginErr, err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRetryLoadOnLockContention(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	options.RedshiftConfiguration.LockRetries = 1
+	options.Backoff = s3box.ConstantBackoff(time.Millisecond)
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	// The table is locked at first, after which the whole transaction is retried
+	copyStmt := redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))
+	mock.ExpectBegin()
+	mock.ExpectExec(copyStmt).WillReturnError(&pq.Error{Code: "55P03", Message: "could not obtain lock on relation"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec(copyStmt).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNoLockRetryOnOtherErrors(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	options.RedshiftConfiguration.LockRetries = 2
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	copyErr := &pq.Error{Code: "42P01", Message: "relation does not exist"}
+	mock.ExpectBegin()
+	mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnError(copyErr)
+	mock.ExpectRollback()
+
+	_, err = redbox.Ship()
+	assert.Equal(copyErr, err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestShipWithResult(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 2
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	mock.ExpectBegin()
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_%d.manifest", testManifestSlug, i))).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(lastCopyIDQuery)).WillReturnRows(sqlmock.NewRows([]string{"pg_last_copy_id"}).AddRow(100 + i))
+	}
+	mock.ExpectCommit()
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	result, err := redbox.ShipWithResult()
+	assert.NoError(err)
+	assert.Equal(ShipResult{
+		Schema:    schema,
+		Table:     table,
+		Manifests: []string{fmt.Sprintf("%s_0.manifest", testManifestSlug), fmt.Sprintf("%s_1.manifest", testManifestSlug)},
+		QueryIDs:  []int64{100, 101},
+		Rows:      1,
+	}, result)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestOnShipSuccess(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	var results []ShipResult
+	options := testOptions
+	options.NumManifests = 1
+	options.OnShipSuccess = func(result ShipResult) {
+		results = append(results, result)
+		panic("notification failed")
+	}
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	copyStmt := redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))
+
+	// A failed ship doesn't invoke the callback
+	mock.ExpectBegin()
+	mock.ExpectExec(copyStmt).WillReturnError(fmt.Errorf("COPY failed"))
+	mock.ExpectRollback()
+	assert.NoError(redbox.Pack(data))
+	_, err = redbox.ShipAndContinue()
+	assert.Error(err)
+	assert.Empty(results)
+
+	// The callback's panic is recovered, leaving the box shipped and reset
+	mock.ExpectBegin()
+	mock.ExpectExec(copyStmt).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	manifests, err := redbox.ShipAndContinue()
+	assert.NoError(err)
+	assert.Equal([]ShipResult{{Schema: schema, Table: table, Manifests: manifests, Rows: 1}}, results)
+	assert.Equal([]string{fmt.Sprintf("%s_0.manifest", testManifestSlug)}, manifests)
+	assert.False(redbox.isShippingInProgress())
+	assert.NoError(redbox.Pack(data))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestHasData(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	redbox := newRedboxInjection(testOptions, &MockSuccessS3Box{}, redshift)
+	assert.False(redbox.HasData())
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	assert.True(redbox.HasData())
+	assert.NoError(mock.ExpectationsWereMet()) // Assert no SQL statements were made.
+}
+
+func TestCopyCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	// Default to the upload credentials
+	redbox := newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+	assert.Contains(redbox.copyStatement(schema, table, testManifestSlug),
+		fmt.Sprintf("CREDENTIALS 'aws_access_key_id=%s;aws_secret_access_key=%s'", awsKey, awsPassword))
+
+	options := testOptions
+	options.CopyAWSKey = "copyKey"
+	options.CopyAWSPassword = "copySecret"
+	redbox = newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+	copyStmt := redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(copyStmt, "CREDENTIALS 'aws_access_key_id=copyKey;aws_secret_access_key=copySecret'")
+	assert.NotContains(copyStmt, "aws_secret_access_key="+awsPassword)
+
+	options = testOptions
+	options.CopyIAMRole = "arn:aws:iam::123456789012:role/redshift-copy"
+	redbox = newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+	copyStmt = redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(copyStmt, "CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/redshift-copy'")
+	assert.NotContains(copyStmt, "aws_secret_access_key="+awsPassword)
+}
+
+func TestInvalidCopyCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	options := testOptions
+	options.CopyAWSKey = "copyKey"
+	_, err := NewRedbox(options)
+	assert.Equal(errIncompleteCopyKeys, err)
+
+	options = testOptions
+	options.CopyAWSPassword = "copySecret"
+	_, err = NewRedbox(options)
+	assert.Equal(errIncompleteCopyKeys, err)
+
+	options = testOptions
+	options.CopyAWSKey = "copyKey"
+	options.CopyAWSPassword = "copySecret"
+	options.CopyIAMRole = "arn:aws:iam::123456789012:role/redshift-copy"
+	_, err = NewRedbox(options)
+	assert.Equal(errAmbiguousCopyCreds, err)
+}
+
+func TestIncompleteAWSKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	options := testOptions
+	options.AWSPassword = ""
+	_, err := NewRedbox(options)
+	assert.Equal(errIncompleteAWSKeys, err)
+
+	options = testOptions
+	options.AWSKey = ""
+	_, err = NewRedbox(options)
+	assert.Equal(errIncompleteAWSKeys, err)
+}
+
+func TestCustomTimeAndDateFormats(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.TimeFormat = "YYYY-MM-DD HH:MI:SS"
+	options.DateFormat = "MM/DD/YYYY"
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+
+	copyStmt := redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(copyStmt, "TIMEFORMAT 'YYYY-MM-DD HH:MI:SS' DATEFORMAT 'MM/DD/YYYY' TRUNCATECOLUMNS")
+	assert.NotContains(copyStmt, "'auto' TRUNCATECOLUMNS")
+
+	// Without overrides, TIMEFORMAT falls back to auto and DATEFORMAT is omitted
+	redbox = newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+	copyStmt = redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(copyStmt, "TIMEFORMAT 'auto' TRUNCATECOLUMNS")
+	assert.NotContains(copyStmt, "DATEFORMAT")
+}
+
+func TestInvalidTimeAndDateFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	options := testOptions
+	options.TimeFormat = "  "
+	_, err := NewRedbox(options)
+	assert.Equal(errInvalidTimeFormat, err)
+
+	options = testOptions
+	options.DateFormat = "YYYY' --"
+	_, err = NewRedbox(options)
+	assert.Equal(errInvalidDateFormat, err)
+}
+
+func TestDebugCopyOmitsGzip(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.Debug = true
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+
+	copyStmt := redbox.copyStatement(schema, table, testManifestSlug)
+	assert.Contains(copyStmt, fmt.Sprintf("REGION '%s' JSON 'auto' TIMEFORMAT", s3Region))
+	assert.NotContains(copyStmt, "GZIP")
+}
+
+func TestRedshiftConnectionStrings(t *testing.T) {
+	assert := assert.New(t)
+
+	provisioned := RedshiftConfiguration{
+		Host:     "cluster.abc123.us-west-1.redshift.amazonaws.com",
+		Port:     "5439",
+		User:     "user",
+		Password: "pass",
+		Database: "db",
+	}
+	connectionString, err := provisioned.connectionString()
+	assert.NoError(err)
+	assert.Equal("host=cluster.abc123.us-west-1.redshift.amazonaws.com port=5439 dbname=db user=user password=pass connect_timeout=10", connectionString)
+
+	// Serverless endpoints are derived from the workgroup with the default port
+	serverless := RedshiftConfiguration{
+		Workgroup:           "wg",
+		ServerlessAccountID: "123456789012",
+		ServerlessRegion:    "us-east-1",
+		User:                "user",
+		Password:            "pass",
+		Database:            "db",
+	}
+	connectionString, err = serverless.connectionString()
+	assert.NoError(err)
+	assert.Equal("host=wg.123456789012.us-east-1.redshift-serverless.amazonaws.com port=5439 dbname=db user=user password=pass connect_timeout=10", connectionString)
+
+	// An explicit endpoint and port take precedence
+	serverless.ServerlessEndpoint = "custom.endpoint.com"
+	serverless.Port = "5440"
+	connectionString, err = serverless.connectionString()
+	assert.NoError(err)
+	assert.Equal("host=custom.endpoint.com port=5440 dbname=db user=user password=pass connect_timeout=10", connectionString)
+}
+
+func TestInvalidRedshiftConfigurations(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := (&RedshiftConfiguration{}).RedshiftConnection()
+	assert.Equal(errRedshiftHostRequired, err)
+
+	_, err = (&RedshiftConfiguration{Host: "host", Workgroup: "wg", ServerlessEndpoint: "endpoint"}).RedshiftConnection()
+	assert.Equal(errAmbiguousRedshiftHost, err)
+
+	_, err = (&RedshiftConfiguration{Workgroup: "wg", ServerlessRegion: "us-east-1"}).RedshiftConnection()
+	assert.Equal(errIncompleteServerless, err)
+}
+
+func TestResetAfterShip(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.Equal(redbox.Pack(data), errBoxShipped)
+
+	assert.NoError(redbox.Reset())
+	assert.False(redbox.HasData())
+	assert.NoError(redbox.Pack(data))
+	assert.True(redbox.HasData())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNoResetDuringShipping(t *testing.T) {
+	assert := assert.New(t)
+	redbox := newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+	redbox.setShippingInProgress(true)
+	assert.Equal(errShippingInProgress, redbox.Reset())
+}
+
+func TestConfigIncludesDefaults(t *testing.T) {
+	assert := assert.New(t)
+	redbox, err := NewRedbox(testOptions)
+	assert.NoError(err)
+
+	config := redbox.Config()
+	assert.Equal(s3Region, config.S3Region)
+	assert.Equal(defaultNumManifests, config.NumManifests)
+	assert.Equal(s3box.DefaultBufferSize, config.BufferSize)
+	assert.Equal(schema, config.Schema)
+
+	// The returned options are a copy
+	config.Table = "other"
+	assert.Equal(table, redbox.Config().Table)
+}
+
+func TestDestinationFunc(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Truncate = true
+	options.NumManifests = 1
+	options.DestinationFunc = func() (string, string, error) {
+		return "customer", "events_42", nil
+	}
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "customer"."events_42"`).WillReturnResult(sqlmock.NewResult(1, 1))
+	copyStmt := redbox.copyStatement("customer", "events_42", fmt.Sprintf("%s_0.manifest", testManifestSlug))
+	assert.Contains(copyStmt, `COPY "customer"."events_42"`)
+	mock.ExpectExec(regexp.QuoteMeta(copyStmt)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDestinationFuncErrorAbortsShip(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.DestinationFunc = func() (string, string, error) {
+		return "", "", fmt.Errorf("unknown customer")
+	}
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	_, err = redbox.Ship()
+	assert.Error(err)
+	assert.Contains(err.Error(), "unknown customer")
+	assert.False(redbox.isShipped())
+	assert.NoError(mock.ExpectationsWereMet()) // Assert no SQL statements were made.
+
+	redbox.o.DestinationFunc = func() (string, string, error) {
+		return "customer", "", nil
+	}
+	_, err = redbox.Ship()
+	assert.Equal(errIncompleteDestination, err)
+}
+
+func TestShipAndContinue(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockRecordingS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	redbox := newRedboxInjection(testOptions, s3Box, redshift)
+
+	nShips := 3
+	for i := 0; i < nShips; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+
+	var expectedBatches [][]string
+	for i := 0; i < nShips; i++ {
+		var batch []string
+		for j := 0; j < 2; j++ {
+			data, _ := json.Marshal(map[string]interface{}{"ship": i, "row": j})
+			assert.NoError(redbox.Pack(data))
+			batch = append(batch, string(data))
+		}
+		expectedBatches = append(expectedBatches, batch)
+
+		manifests, err := redbox.ShipAndContinue()
+		assert.NoError(err)
+		assert.Equal(1, len(manifests))
+		assert.False(redbox.isShipped())
+	}
+
+	// Each ship only carries the rows packed since the previous one
+	assert.Equal(expectedBatches, s3Box.batches)
+	_, err = redbox.ShipAndContinue()
+	assert.Equal(errNothingToShip, err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestFlushPassesThrough(t *testing.T) {
+	assert := assert.New(t)
+	redbox, err := NewRedbox(testOptions)
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	redbox.setShippingInProgress(true)
+	assert.Equal(errShippingInProgress, redbox.Flush())
+	redbox.setShippingInProgress(false)
+	redbox.markShipped()
+	assert.Equal(errBoxShipped, redbox.Flush())
+}
+
+func TestStatUpdateAndCompUpdate(t *testing.T) {
+	assert := assert.New(t)
+	on, off := true, false
+	for _, test := range []struct {
+		statUpdate *bool
+		compUpdate *bool
+		expected   string
+	}{
+		{nil, nil, "TRUNCATECOLUMNS CREDENTIALS"},
+		{&on, nil, "TRUNCATECOLUMNS STATUPDATE ON CREDENTIALS"},
+		{nil, &off, "TRUNCATECOLUMNS COMPUPDATE OFF CREDENTIALS"},
+		{&on, &on, "TRUNCATECOLUMNS STATUPDATE ON COMPUPDATE ON CREDENTIALS"},
+		{&off, &off, "TRUNCATECOLUMNS STATUPDATE OFF COMPUPDATE OFF CREDENTIALS"},
+		{&off, &on, "TRUNCATECOLUMNS STATUPDATE OFF COMPUPDATE ON CREDENTIALS"},
+	} {
+		options := testOptions
+		options.StatUpdate = test.statUpdate
+		options.CompUpdate = test.compUpdate
+		redbox := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+		assert.Contains(redbox.copyStatement(schema, table, testManifestSlug), test.expected)
+	}
+}
+
+func TestAutoShipOnceShipRecommended(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockRecordingS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.MaxFilesBeforeShip = 1
+	options.AutoShip = true
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	assert.False(redbox.ShipRecommended())
+
+	// The s3Box recommends a ship once enough files accumulate, which the next pack performs
+	redbox.recommendShip()
+	assert.True(redbox.ShipRecommended())
+	assert.NoError(redbox.Pack(data))
+	assert.False(redbox.ShipRecommended())
+	assert.False(redbox.isShipped())
+	assert.Equal(1, len(s3Box.batches))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestShipRecommendedWithoutAutoShip(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.MaxFilesBeforeShip = 1
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+
+	redbox.recommendShip()
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	assert.True(redbox.ShipRecommended())
+	assert.NoError(redbox.Reset())
+	assert.False(redbox.ShipRecommended())
+}
+
+// MockRecommendingS3Box recommends a ship from Pack while holding its lock, as an S3Box does,
+// waiting for a Reset to be underway before doing so.
+type MockRecommendingS3Box struct {
+	MockSuccessS3Box
+	mt        sync.Mutex
+	recommend func()
+	packing   chan struct{}
+	resetting chan struct{}
+}
+
+func (m *MockRecommendingS3Box) Pack(data []byte) error {
+	m.mt.Lock()
+	defer m.mt.Unlock()
+	close(m.packing)
+	<-m.resetting
+	m.recommend()
+	return nil
+}
+
+func (m *MockRecommendingS3Box) Reset() {
+	close(m.resetting)
+	m.mt.Lock()
+	defer m.mt.Unlock()
+}
+
+func TestShipRecommendedWithConcurrentReset(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.MaxFilesBeforeShip = 1
+	s3Box := &MockRecommendingS3Box{packing: make(chan struct{}), resetting: make(chan struct{})}
+	redbox := newRedboxInjection(options, s3Box, nil)
+	s3Box.recommend = redbox.recommendShip
+
+	// A Pack recommending a ship under the s3Box's lock doesn't wait on the Reset,
+	// which holds the box's lock while waiting on the s3Box's
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.NoError(redbox.Pack(data))
+	}()
+	go func() {
+		defer wg.Done()
+		<-s3Box.packing
+		assert.NoError(redbox.Reset())
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pack and Reset deadlocked")
+	}
+}
+
+func TestPlanForTruncateLoadWithMultipleManifests(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Truncate = true
+	options.NumManifests = 2
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	nRows := 5
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < nRows; i++ {
+		assert.NoError(redbox.Pack(data))
+	}
+
+	plan, err := redbox.Plan()
+	assert.NoError(err)
+	assert.Equal(schema, plan.Schema)
+	assert.Equal(table, plan.Table)
+	assert.Equal([]string{testManifestSlug + "_0.manifest", testManifestSlug + "_1.manifest"}, plan.Manifests)
+	assert.Equal(mockDataFiles(), plan.DataFiles)
+	assert.Equal(nRows, plan.Rows)
+	assert.Equal(fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", schema, table), plan.DeleteStatement)
+	assert.Equal(2, len(plan.CopyStatements))
+	for i, copyStmt := range plan.CopyStatements {
+		assert.Contains(copyStmt, fmt.Sprintf("FROM 's3://%s/%s'", s3Bucket, plan.Manifests[i]))
+		assert.Contains(copyStmt, redactedCredentials)
+		assert.NotContains(copyStmt, awsKey)
+		assert.NotContains(copyStmt, "aws_secret_access_key="+awsPassword)
+	}
+
+	// Planning neither ships nor touches Redshift
+	assert.False(redbox.isShipped())
+	assert.True(redbox.HasData())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPlanDirectCopyWithoutTruncate(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	useManifest := false
+	options.UseManifest = &useManifest
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	plan, err := redbox.Plan()
+	assert.NoError(err)
+	assert.Empty(plan.Manifests)
+	assert.Empty(plan.DeleteStatement)
+	assert.Equal(testNumDataFiles, len(plan.CopyStatements))
+	assert.NotContains(plan.CopyStatements[0], "MANIFEST")
+}
+
+func TestStageAndCommitSeparately(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.NumManifests = 2
+	stager := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(stager.Pack(data))
+	staged, err := stager.Stage()
+	assert.NoError(err)
+	assert.Equal(StageResult{
+		Schema:    schema,
+		Table:     table,
+		Manifests: []string{fmt.Sprintf("%s_0.manifest", testManifestSlug), fmt.Sprintf("%s_1.manifest", testManifestSlug)},
+		Rows:      1,
+	}, staged)
+	assert.True(stager.isShipped())
+
+	// The staged load is committed by another box, as if in another process
+	serialized, err := json.Marshal(staged)
+	assert.NoError(err)
+	var deserialized StageResult
+	assert.NoError(json.Unmarshal(serialized, &deserialized))
+
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	committer := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+	mock.ExpectBegin()
+	for _, manifest := range staged.Manifests {
+		mock.ExpectExec(committer.copyStatement(schema, table, manifest)).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	manifests, err := committer.Commit(deserialized)
+	assert.NoError(err)
+	assert.Equal(staged.Manifests, manifests)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	_, err = committer.Commit(StageResult{Schema: schema, Table: table})
+	assert.Equal(errNothingToShip, err)
+}
+
+func TestPrepareManifestsWithoutRedshift(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.NumManifests = 1
+	options.RedshiftConfiguration = RedshiftConfiguration{}
+	redbox, err := NewRedbox(options)
+	assert.NoError(err)
+	assert.Nil(redbox.redshift)
+
+	// Without a connection, shipping fails without touching the box
+	redbox = newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	_, err = redbox.Commit(StageResult{Schema: schema, Table: table, Manifests: []string{testManifestSlug}})
+	assert.Equal(errNoRedshiftConnection, err)
+
+	manifests, err := redbox.PrepareManifests()
+	assert.NoError(err)
+	assert.Equal(1, len(manifests))
+	assert.True(redbox.isShipped())
+}
+
+func TestPrepareManifestsMakesNoSQLCalls(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 2
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	manifests, err := redbox.PrepareManifests()
+	assert.NoError(err)
+	assert.Equal([]string{fmt.Sprintf("%s_0.manifest", testManifestSlug), fmt.Sprintf("%s_1.manifest", testManifestSlug)}, manifests)
+	assert.NoError(mock.ExpectationsWereMet()) // Assert no SQL statements were made.
+}
+
+func TestPreAndPostCopySQL(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Truncate = true
+	options.NumManifests = 2
+	options.PreCopySQL = []string{"ALTER TABLE test.test DISABLE TRIGGER audit"}
+	options.PostCopySQL = []string{"ANALYZE test.test", "ALTER TABLE test.test ENABLE TRIGGER audit"}
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", schema, table))).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(options.PreCopySQL[0]).WillReturnResult(sqlmock.NewResult(0, 0))
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+	for _, manifest := range manifests {
+		mock.ExpectExec(redbox.copyStatement(schema, table, manifest)).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(options.PostCopySQL[0]).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(options.PostCopySQL[1]).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRollbackOnPostCopySQLError(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	options.PostCopySQL = []string{"ANALYZE test.test"}
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	mock.ExpectBegin()
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+	mock.ExpectExec(redbox.copyStatement(schema, table, manifests[0])).WillReturnResult(sqlmock.NewResult(1, 1))
+	postErr := fmt.Errorf("Some ANALYZE Error")
+	mock.ExpectExec(options.PostCopySQL[0]).WillReturnError(postErr)
+	mock.ExpectRollback()
+
+	shippedManifests, err := redbox.Ship()
+	assert.Nil(shippedManifests)
+	assert.Equal(postErr, err)
+	assert.False(redbox.isShipped())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCompactJSON(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockRecordingS3Box{}
+	options := testOptions
+	options.CompactJSON = true
+	redbox := newRedboxInjection(options, s3Box, nil)
+
+	pretty, _ := json.MarshalIndent(map[string]interface{}{"key": "value", "nested": map[string]interface{}{"id": 1}}, "", "  ")
+	assert.Contains(string(pretty), "\n")
+	assert.NoError(redbox.Pack(pretty))
+	assert.Equal([]string{`{"key":"value","nested":{"id":1}}`}, s3Box.rows)
+
+	// Rows are packed as is by default
+	s3Box = &MockRecordingS3Box{}
+	redbox = newRedboxInjection(testOptions, s3Box, nil)
+	assert.NoError(redbox.Pack(pretty))
+	assert.Equal([]string{string(pretty)}, s3Box.rows)
+}
+
+func TestRejectDuplicateKeys(t *testing.T) {
+	assert := assert.New(t)
+	duplicated := []byte(`{"key": "a", "nested": {"key": "b"}, "key": "c"}`)
+	nested := []byte(`{"key": "a", "nested": {"key": "b", "other": ["key"]}}`)
+
+	// By default duplicate keys are accepted
+	redbox := newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+	assert.NoError(redbox.Pack(duplicated))
+
+	options := testOptions
+	options.RejectDuplicateKeys = true
+	s3Box := &MockSuccessS3Box{}
+	redbox = newRedboxInjection(options, s3Box, nil)
+	assert.Equal(ErrDuplicateJSONKey, redbox.Pack(duplicated))
+	assert.NoError(redbox.Pack(nested))
+	assert.Equal(1, s3Box.rows)
+}
+
+func TestRejectEmptyRows(t *testing.T) {
+	assert := assert.New(t)
+
+	// By default empty rows are accepted
+	s3Box := &MockSuccessS3Box{}
+	redbox := newRedboxInjection(testOptions, s3Box, nil)
+	assert.NoError(redbox.Pack([]byte("{}")))
+	assert.Equal(1, s3Box.rows)
+
+	options := testOptions
+	options.RejectEmptyRows = true
+	s3Box = &MockSuccessS3Box{}
+	redbox = newRedboxInjection(options, s3Box, nil)
+	assert.Equal(ErrEmptyRow, redbox.Pack([]byte("{}")))
+	assert.Equal(ErrEmptyRow, redbox.Pack([]byte(" { } ")))
+	assert.Equal(ErrEmptyRow, redbox.Pack([]byte("null")))
+	assert.NoError(redbox.Pack([]byte(`{"key": null}`)))
+	assert.Equal(1, s3Box.rows)
+}
+
+func TestLoadDateDatesManifestSlug(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.LoadDate = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, nil)
+	assert.Equal("test_test_2015-06-01T00:00:00Z", redbox.manifestSlug(schema, table))
+
+	// Without a LoadDate, the slug is dated at shipping
+	redbox = newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+	assert.Contains(redbox.manifestSlug(schema, table), time.Now().Format("2006-01-02"))
+}
+
+func TestWriteLoadMetadata(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 1
+	options.WriteLoadMetadata = true
+	options.Metadata = map[string]interface{}{"job_id": "job-1", "table": "overridden"}
+	redbox := newRedboxInjection(options, s3Box, redshift)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(redbox.Pack(data))
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// User metadata is recorded, but can't override the load's own fields
+	assert.Equal("job-1", s3Box.metadata["job_id"])
+	assert.Equal(schema, s3Box.metadata["schema"])
+	assert.Equal(table, s3Box.metadata["table"])
+	assert.NotEmpty(s3Box.metadata["timestamp"])
+}
+
+func TestValidateBeforeLoad(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 2
+	options.ValidateBeforeLoad = true
+	redbox := newRedboxInjection(options, s3Box, redshift)
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+
+	// The NOLOAD pass is rolled back, then the real load is committed
+	mock.ExpectBegin()
+	for _, manifest := range manifests {
+		mock.ExpectExec(regexp.QuoteMeta(redbox.copyStatement(schema, table, manifest) + " NOLOAD")).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	for _, manifest := range manifests {
+		mock.ExpectExec(regexp.QuoteMeta(redbox.copyStatement(schema, table, manifest)) + "$").WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	_, err = redbox.Ship()
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestFailedValidationSkipsLoad(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockSuccessS3Box{}
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.NumManifests = 2
+	options.ValidateBeforeLoad = true
+	redbox := newRedboxInjection(options, s3Box, redshift)
+	manifests, err := s3Box.CreateManifests(testManifestSlug, redbox.o.NumManifests)
+	assert.NoError(err)
+
+	validationErr := fmt.Errorf("Invalid JSON")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(redbox.copyStatement(schema, table, manifests[0]) + " NOLOAD")).WillReturnError(validationErr)
+	mock.ExpectRollback()
+
+	_, err = redbox.Ship()
+	assert.Equal(&ValidationError{Err: validationErr}, err)
+	assert.False(redbox.isShipped())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestWithOverrides(t *testing.T) {
+	assert := assert.New(t)
+	redbox, err := NewRedbox(testOptions)
+	assert.NoError(err)
+
+	variant, err := redbox.With(func(options *Options) {
+		options.Table = "other"
+		options.Truncate = true
+	})
+	assert.NoError(err)
+	assert.Equal("other", variant.o.Table)
+	assert.True(variant.o.Truncate)
+	assert.Equal(table, redbox.o.Table)
+	assert.False(redbox.o.Truncate)
+
+	// The connection and session are shared, while the data is independent
+	assert.True(redbox.redshift == variant.redshift)
+	assert.True(redbox.o.AWSSession == variant.o.AWSSession)
+	assert.True(redbox.s3Box != variant.s3Box)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(variant.Pack(data))
+	assert.False(redbox.HasData())
+
+	// Changing the Redshift configuration opens a new connection
+	otherCluster, err := redbox.With(func(options *Options) {
+		options.RedshiftConfiguration.Host = "other-host"
+	})
+	assert.NoError(err)
+	assert.True(redbox.redshift != otherCluster.redshift)
+
+	// Overrides are validated like any options
+	_, err = redbox.With(func(options *Options) {
+		options.Table = ""
+	})
+	assert.Equal(errIncompleteArgs, err)
+}
+
+func TestSessionTimezone(t *testing.T) {
+	assert := assert.New(t)
+	for _, timezone := range []string{"America/New_York", ""} {
+		s3Box := &MockSuccessS3Box{}
+		redshift, mock, err := sqlmock.New()
+		assert.NoError(err)
+		options := testOptions
+		options.NumManifests = 1
+		options.Truncate = true
+		options.SessionTimezone = timezone
+		redbox := newRedboxInjection(options, s3Box, redshift)
+
+		// The timezone is set first, scoped to the transaction, and omitted entirely when unset
+		mock.ExpectBegin()
+		if timezone != "" {
+			mock.ExpectExec("^" + regexp.QuoteMeta("SET LOCAL timezone TO 'America/New_York'") + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", schema, table))).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(redbox.copyStatement(schema, table, fmt.Sprintf("%s_0.manifest", testManifestSlug))).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		_, err = redbox.Ship()
+		assert.NoError(err)
+		assert.NoError(mock.ExpectationsWereMet())
+	}
+}
+
+func TestPingRedshift(t *testing.T) {
+	assert := assert.New(t)
+	redbox := newRedboxInjection(testOptions, &MockSuccessS3Box{}, nil)
+	assert.Equal(errNoRedshiftConnection, redbox.PingRedshift(context.Background()))
+
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	redbox = newRedboxInjection(testOptions, &MockSuccessS3Box{}, redshift)
+	assert.NoError(redbox.PingRedshift(context.Background()))
+	assert.NoError(mock.ExpectationsWereMet()) // Assert no SQL statements were made.
+
+	redshift.Close()
+	assert.Error(redbox.PingRedshift(context.Background()))
+}
+
+func TestEnsureSchema(t *testing.T) {
+	assert := assert.New(t)
+	redshift, mock, err := sqlmock.New()
+	assert.NoError(err)
+	options := testOptions
+	options.Schema = `my"schema`
+	redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE SCHEMA IF NOT EXISTS "my""schema"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	assert.NoError(redbox.EnsureSchema())
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The owner is quoted too, and a failure rolls back
+	options.SchemaOwner = "loader"
+	redbox = newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+	createErr := fmt.Errorf("permission denied for database")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE SCHEMA IF NOT EXISTS "my""schema" AUTHORIZATION "loader"`)).WillReturnError(createErr)
+	mock.ExpectRollback()
+	assert.Equal(createErr, redbox.EnsureSchema())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestInvalidSessionTimezone(t *testing.T) {
+	assert := assert.New(t)
+	options := testOptions
+	options.SessionTimezone = "UTC'; DROP TABLE test; --"
+	_, err := NewRedbox(options)
+	assert.Equal(errInvalidTimezone, err)
+
+	options.SessionTimezone = "+05:30"
+	_, err = NewRedbox(options)
+	assert.NoError(err)
+}
+
+func TestPackChannel(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockRecordingS3Box{}
+	redbox := newRedboxInjection(testOptions, s3Box, nil)
+
+	nRows := 10
+	rows := make(chan []byte, nRows)
+	var expected []string
+	for i := 0; i < nRows; i++ {
+		data, _ := json.Marshal(map[string]interface{}{"row": i})
+		rows <- data
+		expected = append(expected, string(data))
+	}
+	close(rows)
+
+	packed, err := redbox.PackChannel(context.Background(), rows)
+	assert.NoError(err)
+	assert.Equal(nRows, packed)
+	assert.Equal(expected, s3Box.rows)
+
+	// Invalid rows abort packing
+	rows = make(chan []byte, 2)
+	rows <- []byte("not json")
+	rows <- []byte(expected[0])
+	packed, err = redbox.PackChannel(context.Background(), rows)
+	assert.Equal(errInvalidJSONInput, err)
+	assert.Equal(0, packed)
+	assert.Equal(1, len(rows))
+}
+
+func TestPackChannelCancellation(t *testing.T) {
+	assert := assert.New(t)
+	s3Box := &MockRecordingS3Box{}
+	redbox := newRedboxInjection(testOptions, s3Box, nil)
+
+	// The channel is never closed, so only canceling stops packing
+	rows := make(chan []byte)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var packed int
+	var err error
+	go func() {
+		packed, err = redbox.PackChannel(ctx, rows)
+		close(done)
+	}()
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	rows <- data
+	rows <- data
+	cancel()
+	<-done
+	assert.Equal(context.Canceled, err)
+	assert.Equal(2, packed)
+	assert.Equal(2, len(s3Box.rows))
+}
+
+func TestRecommendedManifests(t *testing.T) {
+	assert := assert.New(t)
+	// Aligned to the total slices
+	assert.Equal(8, RecommendedManifests(4, 2, 100))
+	assert.Equal(32, RecommendedManifests(2, 16, 32))
+	// Clamped to the number of data files
+	assert.Equal(3, RecommendedManifests(4, 2, 3))
+	assert.Equal(1, RecommendedManifests(1, 2, 1))
+	// An unknown file count isn't clamped
+	assert.Equal(8, RecommendedManifests(4, 2, 0))
+	// Without a valid cluster size the default is used
+	assert.Equal(defaultNumManifests, RecommendedManifests(0, 2, 100))
+	assert.Equal(2, RecommendedManifests(4, 0, 2))
+}
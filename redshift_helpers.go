@@ -2,15 +2,30 @@ package redbox
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"net"
+	"strings"
 
-	_ "github.com/Clever/pq" // Postgres driver
+	"github.com/Clever/pq" // Postgres driver
 )
 
-// defaultConnectionTimeout is the default timeout, in seconds, for attempting to connect to Redshift
-const defaultConnectionTimeout = 10
+const (
+	// defaultConnectionTimeout is the default timeout, in seconds, for attempting to connect to Redshift
+	defaultConnectionTimeout = 10
 
-// RedshiftConfiguration specifies the connection to a Redshift Database
+	// defaultServerlessPort is the port Redshift Serverless workgroups listen on by default
+	defaultServerlessPort = "5439"
+)
+
+var (
+	errRedshiftHostRequired  = fmt.Errorf("a Redshift Host or serverless Workgroup is required")
+	errAmbiguousRedshiftHost = fmt.Errorf("cannot provide both a Redshift Host and a serverless Workgroup")
+	errIncompleteServerless  = fmt.Errorf("a serverless Workgroup requires either a ServerlessEndpoint or both a ServerlessAccountID and ServerlessRegion")
+)
+
+// RedshiftConfiguration specifies the connection to a Redshift Database.
+// Either the Host of a provisioned cluster or a Redshift Serverless Workgroup must be provided.
 type RedshiftConfiguration struct {
 	Host              string
 	Port              string
@@ -18,17 +33,114 @@ type RedshiftConfiguration struct {
 	Password          string
 	Database          string
 	ConnectionTimeout int
+
+	// ConnectRetries is the number of times to retry connection-level failures
+	// when starting a load, e.g. while a paused cluster resumes, waiting as
+	// determined by the Redbox's Backoff in between. Defaults to 0.
+	ConnectRetries int
+
+	// LockRetries is the number of times a load failing on lock contention, e.g. as another
+	// process holds a lock on the destination table, is retried as a whole, waiting as
+	// determined by the Redbox's Backoff in between. It's tuned separately from ConnectRetries,
+	// as locks are typically released shortly. Defaults to 0.
+	LockRetries int
+
+	// Workgroup is the Redshift Serverless workgroup to connect to, in place of a Host.
+	Workgroup string
+
+	// ServerlessEndpoint is the endpoint of the serverless Workgroup. If not provided, it's
+	// derived from the Workgroup, ServerlessAccountID and ServerlessRegion.
+	ServerlessEndpoint  string
+	ServerlessAccountID string
+	ServerlessRegion    string
 }
 
 // RedshiftConnection returns a direct redshift connection
 func (rc *RedshiftConfiguration) RedshiftConnection() (*sql.DB, error) {
+	connectionString, err := rc.connectionString()
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("postgres", connectionString)
+}
+
+// connectionString validates the configuration and builds the connection string
+// for either a provisioned cluster or a serverless workgroup.
+func (rc *RedshiftConfiguration) connectionString() (string, error) {
+	if rc.Host != "" && rc.Workgroup != "" {
+		return "", errAmbiguousRedshiftHost
+	}
+
+	host, port := rc.Host, rc.Port
+	if rc.Workgroup != "" {
+		host = rc.ServerlessEndpoint
+		if host == "" {
+			if rc.ServerlessAccountID == "" || rc.ServerlessRegion == "" {
+				return "", errIncompleteServerless
+			}
+			host = fmt.Sprintf("%s.%s.%s.redshift-serverless.amazonaws.com", rc.Workgroup, rc.ServerlessAccountID, rc.ServerlessRegion)
+		}
+		if port == "" {
+			port = defaultServerlessPort
+		}
+	}
+	if host == "" {
+		return "", errRedshiftHostRequired
+	}
+
 	connectionTimeout := defaultConnectionTimeout
 	if rc.ConnectionTimeout > 0 {
 		connectionTimeout = rc.ConnectionTimeout
 	}
 
-	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s connect_timeout=%d",
-		rc.Host, rc.Port, rc.Database, rc.User, rc.Password, connectionTimeout)
+	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s connect_timeout=%d",
+		host, port, rc.Database, rc.User, rc.Password, connectionTimeout), nil
+}
 
-	return sql.Open("postgres", connectionString)
+// isConnectionError reports whether err stems from failing to reach Redshift,
+// as opposed to a failing query.
+func isConnectionError(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		// Class 08 covers connection exceptions, 57P03 is returned while the cluster is starting up
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P03"
+	}
+	return false
+}
+
+// isLockError reports whether err stems from lock contention with a concurrent transaction,
+// which is likely to succeed on retry.
+func isLockError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	// 55P03 is lock_not_available and 40P01 deadlock_detected, while Redshift reports
+	// conflicting concurrent writes as a serializable isolation violation
+	return pqErr.Code == "55P03" || pqErr.Code == "40P01" || strings.Contains(pqErr.Message, "Serializable isolation violation")
+}
+
+// RecommendedManifests returns a NumManifests for a cluster with the given number of
+// nodes and slices per node, loading the given number of data files. Loads parallelize
+// best when aligned to the cluster's total slices, but a manifest per data file is the
+// most that's useful. Without a valid cluster size, the default NumManifests is returned.
+func RecommendedManifests(nodeCount, slicesPerNode, fileCount int) int {
+	manifests := defaultNumManifests
+	if nodeCount > 0 && slicesPerNode > 0 {
+		manifests = nodeCount * slicesPerNode
+	}
+	if fileCount > 0 && manifests > fileCount {
+		manifests = fileCount
+	}
+	return manifests
+}
+
+// quoteIdentifier double quotes a Redshift identifier, escaping any embedded quotes.
+func quoteIdentifier(identifier string) string {
+	return fmt.Sprintf("\"%s\"", strings.Replace(identifier, "\"", "\"\"", -1))
 }
@@ -0,0 +1,71 @@
+package s3box
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultBackoff is used for retries when no Backoff is provided.
+var DefaultBackoff Backoff = ExponentialBackoff{Base: time.Second, Max: time.Minute}
+
+// Backoff determines how long to wait before retrying a failed operation, such as
+// an s3 upload or starting a Redshift transaction.
+type Backoff interface {
+	// NextDelay returns the delay before the given retry, counting from 1.
+	NextDelay(attempt int) time.Duration
+}
+
+// ExponentialBackoff doubles the delay on each retry starting from Base, up to Max if set.
+// Each delay is randomly reduced by up to half, so concurrent retries spread out.
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// NextDelay implements Backoff.
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	// Doubling stops at Max, or short of overflowing, however large the Base or attempt
+	delay := b.Base
+	for i := 1; i < attempt && delay > 0; i++ {
+		if b.Max > 0 && delay > b.Max>>1 {
+			delay = b.Max
+			break
+		}
+		if delay > math.MaxInt64>>1 {
+			break
+		}
+		delay <<= 1
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(int64(delay)-half+1))
+}
+
+// ConstantBackoff waits the same delay before every retry.
+type ConstantBackoff time.Duration
+
+// NextDelay implements Backoff.
+func (b ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// LinearBackoff increases the delay by Step on each retry, up to Max if set.
+type LinearBackoff struct {
+	Step time.Duration
+	Max  time.Duration
+}
+
+// NextDelay implements Backoff.
+func (b LinearBackoff) NextDelay(attempt int) time.Duration {
+	delay := b.Step * time.Duration(attempt)
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
@@ -0,0 +1,48 @@
+package s3box
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	assert := assert.New(t)
+	backoff := ExponentialBackoff{Base: time.Second, Max: 5 * time.Second}
+	for _, test := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	} {
+		for i := 0; i < 10; i++ {
+			delay := backoff.NextDelay(test.attempt)
+			assert.True(delay >= test.max/2, "attempt %d delay %s", test.attempt, delay)
+			assert.True(delay <= test.max, "attempt %d delay %s", test.attempt, delay)
+		}
+	}
+	assert.Equal(time.Duration(0), ExponentialBackoff{}.NextDelay(3))
+
+	// Large bases are capped by Max rather than overflowing, and never overflow without one
+	large := ExponentialBackoff{Base: time.Minute, Max: time.Hour}
+	for _, attempt := range []int{7, 31, 40, 1000} {
+		delay := large.NextDelay(attempt)
+		assert.True(delay >= 30*time.Minute && delay <= time.Hour, "attempt %d delay %s", attempt, delay)
+	}
+	assert.True(ExponentialBackoff{Base: time.Minute}.NextDelay(100) > 0)
+}
+
+func TestConstantAndLinearBackoff(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(time.Second, ConstantBackoff(time.Second).NextDelay(5))
+
+	linear := LinearBackoff{Step: time.Second, Max: 3 * time.Second}
+	assert.Equal(time.Second, linear.NextDelay(1))
+	assert.Equal(2*time.Second, linear.NextDelay(2))
+	assert.Equal(3*time.Second, linear.NextDelay(7))
+}
@@ -0,0 +1,52 @@
+package s3box
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+var (
+	// errInvalidEncryptionKey signals an EncryptionKey which isn't a valid AES key
+	errInvalidEncryptionKey = fmt.Errorf("an EncryptionKey must be 16, 24 or 32 bytes, selecting AES-128, AES-192 or AES-256")
+
+	// errCiphertextTooShort signals data too short to have been encrypted by a box
+	errCiphertextTooShort = fmt.Errorf("the encrypted data is too short to contain a nonce")
+)
+
+// newGCM creates an AES-GCM cipher from the key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errInvalidEncryptionKey
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals data with AES-GCM under a random nonce, which prefixes the returned ciphertext.
+func encrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypt opens a data file encrypted with the EncryptionKey, returning its contents.
+// Gzipped data files are encrypted after compression, so the contents are still gzipped.
+func Decrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errCiphertextTooShort
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,66 @@
+package s3box
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSideEncryption(t *testing.T) {
+	assert := assert.New(t)
+	var uploads [][]byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		assert.False(gzip)
+		uploads = append(uploads, data)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		EncryptionKey: key,
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(sb.Pack(data))
+	assert.NoError(sb.Flush())
+	assert.Equal(1, len(uploads))
+
+	// The uploaded file is the encrypted, gzipped data
+	uploaded := uploads[0]
+	assert.False(bytes.Contains(uploaded, data))
+	_, err = Decrypt(bytes.Repeat([]byte{8}, 32), uploaded)
+	assert.Error(err)
+	decrypted, err := Decrypt(key, uploaded)
+	assert.NoError(err)
+	reader, err := gzip.NewReader(bytes.NewReader(decrypted))
+	assert.NoError(err)
+	uncompressed, err := ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(string(data)+"\n", string(uncompressed))
+}
+
+func TestInvalidEncryptionKey(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		EncryptionKey: []byte("too short"),
+	})
+	assert.Equal(errInvalidEncryptionKey, err)
+
+	_, err = Decrypt(bytes.Repeat([]byte{7}, 16), []byte("short"))
+	assert.Equal(errCiphertextTooShort, err)
+}
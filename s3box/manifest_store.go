@@ -0,0 +1,66 @@
+package s3box
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ManifestStore persists the manifests created by CreateManifests.
+type ManifestStore interface {
+	// WriteManifest writes the manifest data under the given key, and returns the
+	// location CreateManifests reports for it. Redshift only reads uncompressed manifests.
+	WriteManifest(key string, data []byte) (string, error)
+}
+
+// ManifestReader is optionally implemented by a ManifestStore which can read back the
+// manifests it wrote, as VerifyManifestRoundtrip requires.
+type ManifestReader interface {
+	// ReadManifest returns the data of the manifest written under the given key.
+	ReadManifest(key string) ([]byte, error)
+}
+
+// s3ManifestStore is the default ManifestStore, uploading manifests to the box's bucket.
+// The key itself is returned as the location, relative to the bucket.
+type s3ManifestStore struct {
+	sb *S3Box
+}
+
+// WriteManifest implements ManifestStore.
+func (s s3ManifestStore) WriteManifest(key string, data []byte) (string, error) {
+	if _, err := s.sb.upload(key, data, false, false); err != nil {
+		return "", err
+	}
+	log.Printf("Wrote manifest to s3://%s/%s\n", s.sb.o.S3Bucket, key)
+	return key, nil
+}
+
+// ReadManifest implements ManifestReader.
+func (s s3ManifestStore) ReadManifest(key string) ([]byte, error) {
+	return getS3Object(s.sb.s3Handler, s.sb.o.S3Bucket, key)
+}
+
+// LocalManifestStore writes manifests to the local filesystem under Dir, e.g.
+// for testing or for workflows not COPYing into Redshift. Manifests still
+// reference data files in s3. The file path is returned as the location.
+type LocalManifestStore struct {
+	Dir string
+}
+
+// WriteManifest implements ManifestStore.
+func (l LocalManifestStore) WriteManifest(key string, data []byte) (string, error) {
+	path := filepath.Join(l.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// ReadManifest implements ManifestReader.
+func (l LocalManifestStore) ReadManifest(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(l.Dir, filepath.FromSlash(key)))
+}
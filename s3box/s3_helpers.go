@@ -3,30 +3,51 @@ package s3box
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-const aesAlgo = "AES256" // Algo used for server-side encryption.
+const (
+	aesAlgo             = "AES256"    // Algo used for server-side encryption.
+	maxDeleteBatch      = 1000        // Maximum number of keys s3 deletes in a single request.
+	defaultLookupRegion = "us-west-1" // Region used to look up bucket locations in the commercial partition.
+)
 
 // Modularize functions for testing
 var (
-	GetRegionForBucket func(string) (string, error)
-	writeToS3          func(s3Handler *s3.S3, bucket string, fileKey string, data []byte, gzip bool) error
+	GetRegionForBucket     func(string) (string, error)
+	GetRegionForBucketFrom func(bucket, lookupRegion string) (string, error)
+	writeToS3              func(s3Handler *s3.S3, bucket string, fileKey string, data []byte, gzip bool) (int64, error)
+	listS3ObjectsPage      func(s3Handler *s3.S3, bucket, prefix, continuationToken string) ([]*s3.Object, string, error)
+	deleteS3Objects        func(s3Handler *s3.S3, bucket string, keys []string) error
+	headS3Object           func(s3Handler *s3.S3, bucket, key string) (bool, error)
+	headS3Bucket           func(s3Handler *s3.S3, bucket string) error
+	getS3Object            func(s3Handler *s3.S3, bucket, key string) ([]byte, error)
+	putS3Object            func(s3Handler *s3.S3, bucket, key string, body []byte) error
 )
 
-// getRegionForBucketProd looks up the region name for the given bucket
+// getRegionForBucketProd looks up the region name for the given bucket from the default lookup region.
 func getRegionForBucketProd(name string) (string, error) {
-	// Any region will work for the region lookup, but the request MUST use PathStyle
-	config := aws.NewConfig().WithRegion("us-west-1").WithS3ForcePathStyle(true)
-	session := session.New()
-	client := s3.New(session, config)
+	return getRegionForBucketFromProd(name, "")
+}
+
+// getRegionForBucketFromProd looks up the region name for the given bucket.
+// The lookup itself is made from lookupRegion, see resolveLookupRegion.
+func getRegionForBucketFromProd(name, lookupRegion string) (string, error) {
+	client := newLookupClient(resolveLookupRegion(lookupRegion))
 	params := s3.GetBucketLocationInput{
 		Bucket: aws.String(name),
 	}
@@ -34,16 +55,62 @@ func getRegionForBucketProd(name string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Failed to get location for bucket '%s', %s", name, err)
 	}
-	if resp.LocationConstraint == nil {
-		// "US Standard", returns an empty region. So return any region in the US
-		return "us-east-1", nil
+	return regionForLocationConstraint(resp.LocationConstraint), nil
+}
+
+// regionForLocationConstraint maps a bucket's location constraint to its region,
+// handling the legacy values returned for some older buckets.
+func regionForLocationConstraint(constraint *string) string {
+	switch aws.StringValue(constraint) {
+	case "":
+		// "US Standard", returns an empty region, or none at all
+		return "us-east-1"
+	case "EU":
+		// Some older buckets in eu-west-1 report the legacy "EU" constraint
+		return "eu-west-1"
+	default:
+		return *constraint
+	}
+}
+
+// AccessPointRegion validates an s3 access point ARN, returning the region it's in.
+func AccessPointRegion(arn string) (string, error) {
+	match := accessPointARNPattern.FindStringSubmatch(arn)
+	if match == nil {
+		return "", errInvalidAccessPointARN
 	}
-	return *resp.LocationConstraint, nil
+	return match[1], nil
 }
 
-// uploadToS3 streams readers to an encrypted s3 file.
-func uploadToS3(s3Handler *s3.S3, bucket, fileKey string, data io.Reader) error {
-	uploader := s3manager.NewUploaderWithClient(s3Handler)
+// resolveLookupRegion determines the region bucket location lookups are made from.
+// The lookup region must exist in the bucket's partition, so an explicitly provided
+// region is used first, then the environment's region, e.g. for GovCloud or China,
+// and finally us-west-1 for the commercial partition.
+func resolveLookupRegion(region string) string {
+	if region != "" {
+		return region
+	}
+	if region = os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	if region = os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	return defaultLookupRegion
+}
+
+// newLookupClient creates an s3 client for bucket location lookups.
+// Any region in the bucket's partition will work for the lookup, but the request MUST use PathStyle
+func newLookupClient(region string) *s3.S3 {
+	config := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(true)
+	return s3.New(session.New(), config)
+}
+
+// uploadToS3 streams readers of up to maxSize bytes to an encrypted s3 file.
+func uploadToS3(s3Handler *s3.S3, bucket, fileKey string, data io.Reader, maxSize int64) error {
+	uploader := s3manager.NewUploaderWithClient(s3Handler, func(u *s3manager.Uploader) {
+		u.PartSize = partSizeFor(maxSize)
+	})
 	_, err := uploader.Upload(&s3manager.UploadInput{
 		Body:                 data,
 		Bucket:               aws.String(bucket),
@@ -53,6 +120,23 @@ func uploadToS3(s3Handler *s3.S3, bucket, fileKey string, data io.Reader) error
 	return err
 }
 
+// partSizeFor returns the smallest part size uploading size bytes within s3's limit on the
+// number of parts, and no smaller than s3's minimum part size. The uploader can't determine
+// the size of streamed bodies itself, so would otherwise fail past 10,000 default-sized parts.
+func partSizeFor(size int64) int64 {
+	partSize := (size + s3manager.MaxUploadParts - 1) / s3manager.MaxUploadParts
+	if partSize < s3manager.MinUploadPartSize {
+		return s3manager.MinUploadPartSize
+	}
+	return partSize
+}
+
+// gzipBound conservatively bounds the size of n bytes once gzip compressed. Incompressible
+// data is stored in blocks each adding a 5 byte header, along with the gzip header and footer.
+func gzipBound(n int64) int64 {
+	return n + 5*(n/16384+1) + 18
+}
+
 // compressAndWriteBytesToS3 creates a gzip compression for writing to s3.
 //
 // The mechanics of this function deserve some attention. AWSs upload requires a reader
@@ -60,8 +144,10 @@ func uploadToS3(s3Handler *s3.S3, bucket, fileKey string, data io.Reader) error
 // We accomplish this by creating a reader/writer pair returned from io.Pipe().
 // To correctly use this pair we need the reader to be hooked up to a sync before writing any data,
 // thus we set off two go routines, one for hooking up the source (the data to write) and another
-// for establishing the sync (the destination s3 file).
-func compressAndWriteBytesToS3(s3Handler *s3.S3, bucket, key string, data []byte) error {
+// for establishing the sync (the destination s3 file). The compressed bytes are counted as they
+// stream through, and their total returned.
+func compressAndWriteBytesToS3(s3Handler *s3.S3, bucket, key string, data []byte) (int64, error) {
+	var counter countingWriter
 	var wg sync.WaitGroup
 	var writeErr error
 	var streamErr error
@@ -71,7 +157,7 @@ func compressAndWriteBytesToS3(s3Handler *s3.S3, bucket, key string, data []byte
 	// Source initiation
 	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
-		gzipWriter := gzip.NewWriter(writer)
+		gzipWriter := gzip.NewWriter(io.MultiWriter(writer, &counter))
 		defer writer.Close()
 		defer gzipWriter.Close()
 		_, writeErr = gzipWriter.Write(data)
@@ -80,23 +166,188 @@ func compressAndWriteBytesToS3(s3Handler *s3.S3, bucket, key string, data []byte
 	// Sink initiation
 	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
-		streamErr = uploadToS3(s3Handler, bucket, key, reader)
+		streamErr = uploadToS3(s3Handler, bucket, key, reader, gzipBound(int64(len(data))))
 	}(&wg)
 	wg.Wait()
 	if writeErr != nil {
-		return writeErr
+		return 0, writeErr
+	}
+	if streamErr != nil {
+		return 0, streamErr
+	}
+	return counter.n, nil
+}
+
+// gzipBytes gzip compresses data in memory.
+func gzipBytes(data []byte) ([]byte, error) {
+	return gzipBytesWithHeader(data, "", time.Time{})
+}
+
+// gzipBytesWithHeader gzip compresses data in memory, setting the header's name and modification time.
+func gzipBytesWithHeader(data []byte, name string, modTime time.Time) ([]byte, error) {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Name = name
+	gzipWriter.ModTime = modTime
+	if _, err := gzipWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// putObjectInput creates the input of a single encrypted PutObject, with a Content-MD5
+// header so s3 rejects the upload if the body was corrupted in transit.
+func putObjectInput(bucket, key string, body []byte) *s3.PutObjectInput {
+	checksum := md5.Sum(body)
+	return &s3.PutObjectInput{
+		Body:                 bytes.NewReader(body),
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ContentMD5:           aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+		ServerSideEncryption: aws.String(aesAlgo),
+	}
+}
+
+func putS3ObjectProd(s3Handler *s3.S3, bucket, key string, body []byte) error {
+	_, err := s3Handler.PutObject(putObjectInput(bucket, key, body))
+	return err
+}
+
+// countingWriter discards written data, only counting its bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// compressedSize reports the size of data once gzip compressed, without holding onto the compressed bytes.
+func compressedSize(data []byte) (int64, error) {
+	var counter countingWriter
+	gzipWriter := gzip.NewWriter(&counter)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return 0, err
 	}
-	return streamErr
+	if err := gzipWriter.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
 }
 
-func writeToS3Manager(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) error {
+func writeToS3Manager(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
 	if gzip {
 		return compressAndWriteBytesToS3(s3Handler, bucket, key, data)
 	}
-	return uploadToS3(s3Handler, bucket, key, bytes.NewReader(data))
+	if err := uploadToS3(s3Handler, bucket, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// listS3ObjectsPageProd lists a single page of objects under the prefix, returning
+// the token for the next page or an empty string if it's the last page.
+func listS3ObjectsPageProd(s3Handler *s3.S3, bucket, prefix, continuationToken string) ([]*s3.Object, string, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if continuationToken != "" {
+		params.ContinuationToken = aws.String(continuationToken)
+	}
+	resp, err := s3Handler.ListObjectsV2(params)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.IsTruncated == nil || !*resp.IsTruncated || resp.NextContinuationToken == nil {
+		return resp.Contents, "", nil
+	}
+	return resp.Contents, *resp.NextContinuationToken, nil
+}
+
+// listS3Objects lists every object under the prefix, following pagination.
+func listS3Objects(s3Handler *s3.S3, bucket, prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	token := ""
+	for {
+		page, nextToken, err := listS3ObjectsPage(s3Handler, bucket, prefix, token)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page...)
+		if nextToken == "" {
+			return objects, nil
+		}
+		token = nextToken
+	}
+}
+
+// deleteS3ObjectsProd deletes a batch of at most maxDeleteBatch keys.
+func deleteS3ObjectsProd(s3Handler *s3.S3, bucket string, keys []string) error {
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	resp, err := s3Handler.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("Failed to delete %d objects from bucket '%s', first error: %s", len(resp.Errors), bucket, resp.Errors[0])
+	}
+	return nil
+}
+
+// headS3ObjectProd reports whether an object exists, distinguishing a missing object from a failed request.
+func headS3ObjectProd(s3Handler *s3.S3, bucket, key string) (bool, error) {
+	_, err := s3Handler.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	return false, fmt.Errorf("Failed to head s3://%s/%s, %s", bucket, key, err)
+}
+
+// headS3BucketProd checks the bucket is accessible from the handler's region.
+func headS3BucketProd(s3Handler *s3.S3, bucket string) error {
+	_, err := s3Handler.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	return err
+}
+
+func getS3ObjectProd(s3Handler *s3.S3, bucket, key string) ([]byte, error) {
+	resp, err := s3Handler.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get s3://%s/%s, %s", bucket, key, err)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
 }
 
 func init() {
 	GetRegionForBucket = getRegionForBucketProd
+	GetRegionForBucketFrom = getRegionForBucketFromProd
 	writeToS3 = writeToS3Manager
+	listS3ObjectsPage = listS3ObjectsPageProd
+	deleteS3Objects = deleteS3ObjectsProd
+	headS3Object = headS3ObjectProd
+	headS3Bucket = headS3BucketProd
+	getS3Object = getS3ObjectProd
+	putS3Object = putS3ObjectProd
 }
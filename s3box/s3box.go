@@ -1,9 +1,18 @@
 package s3box
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,16 +23,75 @@ import (
 )
 
 const (
-	// defaultBufferSize is set to 10MB
-	defaultBufferSize = 10 * 1000 * 1000
+	// DefaultBufferSize is set to 10MB
+	DefaultBufferSize = 10 * 1000 * 1000
+
+	// keySuffixBytes is the number of random bytes in a RandomKeySuffix
+	keySuffixBytes = 4
 )
 
 var (
+	// stagedKeyPattern matches the keys, following any KeyPrefix, of the data files a box creates
+	// and the manifests of a Redbox, whose slugs end in the RFC3339 load date
+	stagedKeyPattern = regexp.MustCompile(`^(?:\d+_([A-Za-z0-9-]+_)?\d+\.(gz|json)|[^/]+_\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})_\d+\.manifest)$`)
+
+	// dataFileKeyPattern matches the keys, following any KeyPrefix, of the data files a box creates,
+	// capturing their timestamp, optional ShardID and file number
+	dataFileKeyPattern = regexp.MustCompile(`^(\d+)_(?:([A-Za-z0-9-]+)_)?(\d+)\.(gz|json)$`)
+
+	// shardIDPattern matches valid ShardIDs, which can't contain the underscores delimiting keys
+	shardIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+	// accessPointARNPattern matches s3 access point ARNs, capturing their region
+	accessPointARNPattern = regexp.MustCompile(`^arn:aws(?:-cn|-us-gov)?:s3:([a-z0-9-]+):\d{12}:accesspoint/[a-z0-9-]{3,50}$`)
+
 	// errS3BucketRequired signals an s3 bucket wasn't provided
 	errS3BucketRequired = fmt.Errorf("an s3 bucket is required to create an s3box")
 
+	// errInvalidShardID signals a ShardID with characters other than letters, digits and dashes
+	errInvalidShardID = fmt.Errorf("a ShardID may only contain letters, digits and dashes")
+
+	// errInvalidAccessPointARN signals a malformed S3AccessPointARN
+	errInvalidAccessPointARN = fmt.Errorf("an S3AccessPointARN must be of the form arn:aws:s3:<region>:<account-id>:accesspoint/<name>")
+
 	// ErrBoxIsSealed signals an operation which can't occur when a box is sealed.
 	errBoxIsShipped = fmt.Errorf("cannot perform action after creating manifests as box has been shipped")
+
+	// errCompactEncrypted signals compaction was requested for encrypted data files, which can't be concatenated
+	errCompactEncrypted = fmt.Errorf("cannot compact data files encrypted with an EncryptionKey")
+
+	// errBufferNotFlushed signals the timestamp can't be rotated while data is buffered under the current one
+	errBufferNotFlushed = fmt.Errorf("cannot rotate the timestamp while data is buffered, flush it first")
+
+	// errManifestStoreNotReadable signals VerifyManifestRoundtrip with a ManifestStore which can't read manifests back
+	errManifestStoreNotReadable = fmt.Errorf("VerifyManifestRoundtrip requires a ManifestStore implementing ManifestReader")
+
+	// ErrBufferFull signals a Pack was rejected in FlushReject mode, as it would overflow the buffer.
+	ErrBufferFull = fmt.Errorf("cannot pack, the buffer is full and must first be flushed")
+)
+
+// ManifestUploadError signals CreateManifests failed writing a manifest, even after
+// MaxManifestRetries. Written holds the locations of the manifests written before the
+// failure, so the caller can clean them up. The box isn't shipped.
+type ManifestUploadError struct {
+	Written []string
+	Err     error
+}
+
+func (e *ManifestUploadError) Error() string {
+	return fmt.Sprintf("failed writing manifest %d, %s", len(e.Written), e.Err)
+}
+
+// FlushMode determines how Pack behaves once the buffer reaches capacity.
+type FlushMode int
+
+const (
+	// FlushInline uploads the buffer to s3 within the Pack which overflows it. This is the default.
+	FlushInline FlushMode = iota
+
+	// FlushReject fails any Pack which would overflow the buffer with ErrBufferFull,
+	// so Pack never blocks on s3. The caller is responsible for calling Flush.
+	FlushReject
 )
 
 // S3Box manages piping data into S3. The mechanics are to buffer data locally, ship to s3 when too much is buffered, and finally create manifests pointing to the data files.
@@ -40,31 +108,96 @@ type S3Box struct {
 	// bufferedData is the data currently buffered in the box. Calling Dump ships this data into s3
 	bufferedData []byte
 
+	// bufferedRows counts the rows currently held in bufferedData
+	bufferedRows int
+
 	// timestamp tracks the time a box was created or reset
 	timestamp time.Time
 
 	// fileLocations stores the s3 files already created
 	fileLocations []string
 
+	// fileSizes stores the uploaded size in bytes of each file in fileLocations
+	fileSizes []int64
+
+	// fileRows counts the rows across all files already created
+	fileRows int
+
+	// packedRows counts the rows packed since the box was created or reset, which must
+	// all be accounted for by fileRows once the box is flushed
+	packedRows int
+
+	// fileCounter numbers the next data file, independently of the files already created
+	fileCounter int
+
+	// seenKeys tracks the DedupeKeyFunc keys of rows packed since the box was created or reset
+	seenKeys map[string]struct{}
+
+	// lastRowHash is the hash of the last packed row, tracked for DedupeConsecutive
+	lastRowHash    [sha256.Size]byte
+	hasLastRowHash bool
+
+	// keySuffix is the box's RandomKeySuffix, if enabled
+	keySuffix string
+
 	// isShipped indicates whether we've already shipped the box, preventing
 	// any further action
 	isShipped bool
 }
 
+// Stats summarizes the data packed into a box since it was created or reset.
+type Stats struct {
+	// Files is the number of data files written to s3
+	Files int
+
+	// Rows is the number of rows written to s3
+	Rows int
+}
+
+// FlushStats describes a single upload of buffered data to s3.
+type FlushStats struct {
+	// FileKey is the key of the created s3 file
+	FileKey string
+
+	// Rows is the number of rows in the file
+	Rows int
+
+	// Bytes is the uncompressed size of the file's data
+	Bytes int
+
+	// CompressedBytes is the gzip compressed size of the file's data,
+	// estimated locally before uploading. In Debug mode it equals Bytes.
+	CompressedBytes int64
+}
+
 // Options is the expected input for creating a new S3Box.
 // Currently only an S3Bucket is required. If AWS vars aren't explicitly provided, they'll
 // be pulled from your environment.
 type Options struct {
 	// S3Bucket is the destination s3 bucket.
-	// This is required.
+	// This is required, unless an S3AccessPointARN is provided.
 	S3Bucket string
 
+	// S3AccessPointARN optionally addresses the bucket through an access point, e.g.
+	// arn:aws:s3:us-west-2:123456789012:accesspoint/loads. The ARN replaces the S3Bucket
+	// in requests, data file locations and manifest URLs, and determines the S3Region.
+	S3AccessPointARN string
+
 	// S3Region is the region of the s3 bucket.
 	// Optional: If not provided, the region is
 	// looked up via the AWS API. However if provided,
 	// an S3Box can be reestablished without error.
 	S3Region string
 
+	// LookupRegion is the region from which the S3Region is looked up when not provided.
+	// It must be a region in the bucket's partition. Defaults to the AWS_REGION or
+	// AWS_DEFAULT_REGION environment variables, falling back to us-west-1.
+	LookupRegion string
+
+	// CandidateRegions are tried in order when looking up the S3Region fails, e.g. where
+	// GetBucketLocation is denied. The first region a HeadBucket succeeds from is used.
+	CandidateRegions []string
+
 	// AWSKey is the AWS ACCESS KEY ID.
 	// By default grabs from your environment.
 	AWSKey string
@@ -77,31 +210,222 @@ type Options struct {
 	// By default grabs from your environment.
 	AWSToken string
 
+	// NumFiles optionally splits each flush of the buffer evenly into this many data
+	// files at record boundaries, e.g. to match the number of Redshift slices, regardless
+	// of data volume. BufferSize is then ignored and data is buffered in memory until
+	// flushed, so only use this when the full load comfortably fits in memory. A box
+	// flushed only by CreateManifests produces exactly NumFiles files; every earlier
+	// flush, such as by PlanManifests, Flush or DataFiles, adds another NumFiles files,
+	// as does each shard of a ShardedS3Box. Fewer files are produced only if fewer rows
+	// than NumFiles were flushed.
+	NumFiles int
+
+	// FlushMode determines whether a Pack overflowing the buffer uploads it inline, or
+	// is rejected with ErrBufferFull leaving the caller to Flush on its own schedule.
+	// This decouples latency-sensitive producers from s3 latency. Defaults to FlushInline.
+	FlushMode FlushMode
+
+	// KeyPrefix is an optional prefix for the keys of all data files and
+	// manifests created, e.g. "redbox/" to stage everything under a folder.
+	KeyPrefix string
+
+	// VerifyWriteAccess writes and deletes a tiny object under the KeyPrefix when the box
+	// is created, failing fast on missing permissions rather than on the first flush.
+	VerifyWriteAccess bool
+
+	// ShardID optionally identifies the box among concurrent producers writing under the
+	// same KeyPrefix, and is included in its data file keys. Boxes with distinct ShardIDs
+	// can never produce the same key, even if created at the same instant. It may only
+	// contain letters, digits and dashes.
+	ShardID string
+
+	// RandomKeySuffix includes a random suffix, unique to the box, in its data file keys
+	// after any ShardID, so boxes writing to the same bucket never collide even if created
+	// in the same nanosecond, e.g. on platforms with a coarse clock. Off by default, keeping
+	// keys deterministic.
+	RandomKeySuffix bool
+
+	// Session is an optional AWS session shared across boxes, reusing its
+	// configuration and underlying HTTP connection pool. Useful when creating
+	// many boxes, e.g. in multi-table pipelines. If not provided, a new session is created.
+	Session *session.Session
+
 	// BufferSize is the maximum size of data, in bytes,
 	// we buffer internally before creating an s3 file.
 	// This is optional and defaults to 100MB.
 	BufferSize int
+
+	// MaxRecordsPerFile optionally caps the number of rows in each data file, flushing
+	// the buffer once it holds that many rows even if BufferSize isn't reached. Files
+	// then have predictable row counts, with the buffer flushing at whichever limit is
+	// hit first. Like BufferSize, it's ignored when NumFiles is set.
+	MaxRecordsPerFile int
+
+	// MandatoryFunc optionally decides whether each data file, by its s3:// location, is
+	// mandatory in its manifest. A COPY fails if a mandatory file is missing, but skips
+	// missing optional ones. Defaults to every file being mandatory.
+	MandatoryFunc func(fileURL string) bool
+
+	// VisibilityRetries optionally has CreateManifests verify each data file is visible in s3
+	// with a HeadObject before writing manifests, retrying any which aren't yet up to this many
+	// times, waiting as determined by the Backoff. This guards a COPY against a transiently
+	// missing key, e.g. after a retried upload. Files still missing fail CreateManifests.
+	VisibilityRetries int
+
+	// VerifyFilesBeforeManifest has CreateManifests HEAD each data file before writing
+	// manifests without retrying, failing early with the missing keys if any were deleted
+	// since they were written, e.g. by a lifecycle policy or a concurrent cleanup. It's
+	// implied by VisibilityRetries.
+	VerifyFilesBeforeManifest bool
+
+	// ManifestStore optionally determines where manifests are written, e.g. a
+	// LocalManifestStore. Defaults to the S3Bucket, in which case CreateManifests
+	// returns the manifest keys rather than full s3 paths.
+	ManifestStore ManifestStore
+
+	// VerifyManifestRoundtrip has CreateManifests read back each manifest after writing it,
+	// failing unless it parses and lists as many entries as were written, so a corrupted
+	// manifest fails before any COPY. The ManifestStore must implement ManifestReader,
+	// as the default and LocalManifestStore do.
+	VerifyManifestRoundtrip bool
+
+	// Uploader optionally replaces how data files, manifests and the VerifyWriteAccess
+	// check are uploaded, e.g. for alternative backends or tests. It reports the size
+	// of each upload, which FileSizes exposes. Defaults to uploading to s3,
+	// and ContentMD5 only applies to the default.
+	Uploader Uploader
+
+	// MaxObjectSize optionally has CreateManifests first merge runs of consecutive data
+	// files into fewer files of up to this many bytes, as many tiny files from frequent
+	// small flushes slow the COPY, see Compact. Merging downloads and re-uploads the files.
+	MaxObjectSize int64
+
+	// BalanceManifestsBySize distributes data files across manifests by their sizes rather
+	// than round-robin, greedily balancing the bytes each manifest references. This avoids
+	// a manifest of a few huge files timing out when file sizes vary widely.
+	BalanceManifestsBySize bool
+
+	// MaxFilesPerManifest optionally caps the number of data files referenced by
+	// a single manifest. When set, CreateManifests creates more manifests than
+	// requested if needed to honor the cap.
+	MaxFilesPerManifest int
+
+	// FilesPerManifest optionally groups exactly this many consecutive data files into
+	// each manifest, the last holding any remainder, creating as many manifests as needed
+	// regardless of the number requested. It takes precedence over MaxFilesPerManifest
+	// and BalanceManifestsBySize.
+	FilesPerManifest int
+
+	// ContentMD5 uploads files smaller than a multipart upload's part size, 5MB, with a single
+	// PutObject carrying a Content-MD5 header, so s3 rejects any body corrupted in transit.
+	// Larger files fall back to multipart uploads, whose parts are checksummed individually.
+	// Gzipped files are then compressed in memory before uploading, rather than streamed.
+	ContentMD5 bool
+
+	// EncryptionKey optionally encrypts each data file client-side with AES-GCM before
+	// uploading it, after any compression, so the data is unreadable even with access to
+	// the bucket. The key must be 16, 24 or 32 bytes. Manifests aren't encrypted.
+	//
+	// Redshift can't COPY client-side encrypted files, so this is only for custom consumers
+	// reading the files themselves, see Decrypt. Don't use it with a Redbox.
+	EncryptionKey []byte
+
+	// GzipHeaders sets the name and modification time in the header of each gzipped file,
+	// to its key without the ".gz" and the box's timestamp, for tools reading gzip headers.
+	// Files are then compressed in memory before uploading rather than streamed. Off by
+	// default, as it changes the bytes of the uploaded files.
+	GzipHeaders bool
+
+	// UploadRetries is the number of times a failed upload of a data file or manifest
+	// is retried, waiting as determined by the Backoff in between. Defaults to 0.
+	UploadRetries int
+
+	// MaxManifestRetries is the number of times CreateManifests retries writing a manifest
+	// to the ManifestStore, waiting as determined by the Backoff in between, so a transient
+	// failure doesn't fail a load whose data files are already written. With the default
+	// store, this is in addition to the UploadRetries of each attempt. Defaults to 0.
+	MaxManifestRetries int
+
+	// Backoff determines the delay before each upload retry. Defaults to DefaultBackoff,
+	// an exponential backoff with jitter.
+	Backoff Backoff
+
+	// Debug writes data files as uncompressed, newline-delimited JSON with a ".json"
+	// extension rather than gzip, making staged data easy to inspect when debugging
+	// a failed load. It's meant for small debug loads only, not production volume.
+	Debug bool
+
+	// DedupeKeyFunc optionally computes a key for each packed row, dropping any row
+	// whose key was already packed since the box was created or reset. Dropped rows
+	// aren't reported to OnRowPacked. Every key is held in memory until the box is
+	// reset, so for large loads keep the keys short, e.g. an id or a hash of the row.
+	DedupeKeyFunc func(row []byte) string
+
+	// DedupeConsecutive drops any row byte-identical to the row packed immediately before
+	// it, e.g. for noisy sources repeating the same row. Only consecutive duplicates are
+	// dropped, not duplicates anywhere in the load, so only a hash of the last row is held.
+	DedupeConsecutive bool
+
+	// OnRowPacked is an optional hook invoked with each row once it's safely buffered.
+	//
+	// OnRowsFlushed is an optional hook invoked with the number of rows written
+	// after each successful upload of buffered data to s3. Consumers can use it to
+	// commit upstream offsets at flush boundaries rather than per pack.
+	//
+	// Both hooks run while the box is locked, so they must not call back into the box.
+	OnRowPacked   func(row []byte)
+	OnRowsFlushed func(count int)
+
+	// TeeWriter optionally receives a copy of every row once it's buffered, including its
+	// trailing newline, e.g. a local file capturing exactly what is staged in s3 for
+	// debugging. Rows are written in buffer order while the box is locked. Write errors
+	// are logged rather than failing the pack.
+	TeeWriter io.Writer
+
+	// MaxFilesBeforeShip optionally caps how many data files a load should accumulate,
+	// bounding COPY time and the scope of a failed load's recovery. Once that many files
+	// have been written, OnShipRecommended is invoked with the current number of files
+	// after every further upload until the box is reset. The box itself never ships.
+	MaxFilesBeforeShip int
+	OnShipRecommended  func(numFiles int)
+
+	// OnFlush is an optional hook invoked with the stats of each successful upload
+	// of buffered data to s3, e.g. for reporting compression ratios per load.
+	// Computing the compressed size costs an extra local compression of the data,
+	// so it's only done when the hook is set. Like the hooks above, it runs while
+	// the box is locked.
+	OnFlush func(FlushStats)
 }
 
 // NewS3Box creates a new S3Box given the input options.
 // Errors occur if there's an invalid input or if there's difficulty setting up an s3 connection.
 func NewS3Box(options Options) (*S3Box, error) {
 	// Check for required inputs and a valid destination config
+	if options.S3AccessPointARN != "" {
+		region, err := AccessPointRegion(options.S3AccessPointARN)
+		if err != nil {
+			return nil, err
+		}
+		options.S3Bucket = options.S3AccessPointARN
+		options.S3Region = region
+	}
 	if options.S3Bucket == "" {
 		return nil, errS3BucketRequired
 	}
+	if options.ShardID != "" && !shardIDPattern.MatchString(options.ShardID) {
+		return nil, errInvalidShardID
+	}
+	if options.EncryptionKey != nil {
+		if _, err := newGCM(options.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
 
 	if options.BufferSize <= 0 {
-		options.BufferSize = defaultBufferSize
+		options.BufferSize = DefaultBufferSize
 	}
-
-	// Setup s3 handler and aws configuration. If no creds are explicitly provided, they'll be grabbed from the environment.
-	if options.S3Region == "" {
-		region, err := GetRegionForBucket(options.S3Bucket)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to get AWS region for bucket %s: (%s)", options.S3Bucket, err)
-		}
-		options.S3Region = region
+	if options.Backoff == nil {
+		options.Backoff = DefaultBackoff
 	}
 
 	// If AWS creds were provided use those, otherwise grab them from your environment
@@ -114,44 +438,196 @@ func NewS3Box(options Options) (*S3Box, error) {
 		}
 		awsCreds = credentials.NewStaticCredentials(options.AWSKey, options.AWSPassword, options.AWSToken)
 	}
-	awsConfig := aws.NewConfig().WithRegion(options.S3Region).WithS3ForcePathStyle(true).WithCredentials(awsCreds)
-	awsSession := session.New()
+	awsSession := options.Session
+	if awsSession == nil {
+		awsSession = session.New()
+	}
 
-	return &S3Box{
+	// Setup s3 handler and aws configuration. If no creds are explicitly provided, they'll be grabbed from the environment.
+	if options.S3Region == "" {
+		region, err := regionForBucket(options.S3Bucket, options.LookupRegion)
+		if err != nil && len(options.CandidateRegions) > 0 {
+			region, err = candidateRegionForBucket(awsSession, awsCreds, options.S3Bucket, options.CandidateRegions, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get AWS region for bucket %s: (%s)", options.S3Bucket, err)
+		}
+		options.S3Region = region
+	}
+	// Access points can't be addressed path-style
+	forcePathStyle := options.S3AccessPointARN == ""
+	awsConfig := aws.NewConfig().WithRegion(options.S3Region).WithS3ForcePathStyle(forcePathStyle).WithCredentials(awsCreds)
+
+	if options.Debug {
+		log.Printf("S3Box for bucket %s is in debug mode, data files are written uncompressed\n", options.S3Bucket)
+	}
+
+	sb := &S3Box{
 		o:         options,
 		timestamp: time.Now(),
 		s3Handler: s3.New(awsSession, awsConfig),
-	}, nil
+	}
+	if options.RandomKeySuffix {
+		suffix := make([]byte, keySuffixBytes)
+		if _, err := io.ReadFull(rand.Reader, suffix); err != nil {
+			return nil, err
+		}
+		sb.keySuffix = hex.EncodeToString(suffix)
+	}
+	if sb.o.ManifestStore == nil {
+		sb.o.ManifestStore = s3ManifestStore{sb}
+	}
+	if sb.o.Uploader == nil {
+		sb.o.Uploader = s3Uploader{sb}
+	}
+	if _, ok := sb.o.ManifestStore.(ManifestReader); options.VerifyManifestRoundtrip && !ok {
+		return nil, errManifestStoreNotReadable
+	}
+	if options.VerifyWriteAccess {
+		if err := sb.verifyWriteAccess(); err != nil {
+			return nil, err
+		}
+	}
+	return sb, nil
+}
+
+// regionForBucket looks up the region of the bucket, from the lookupRegion if provided.
+func regionForBucket(bucket, lookupRegion string) (string, error) {
+	if lookupRegion == "" {
+		return GetRegionForBucket(bucket)
+	}
+	return GetRegionForBucketFrom(bucket, lookupRegion)
+}
+
+// verifyWriteAccess writes and deletes a tiny object under the KeyPrefix,
+// surfacing missing permissions before any data is packed.
+func (sb *S3Box) verifyWriteAccess() error {
+	key := fmt.Sprintf("%swrite_check_%d", sb.o.KeyPrefix, time.Now().UnixNano())
+	if _, err := sb.o.Uploader.Upload(sb.o.S3Bucket, key, []byte("redbox write check"), false); err != nil {
+		return fmt.Errorf("Failed verifying write access to s3://%s/%s, the PutObject permission may be missing: (%s)", sb.o.S3Bucket, key, err)
+	}
+	if err := deleteS3Objects(sb.s3Handler, sb.o.S3Bucket, []string{key}); err != nil {
+		return fmt.Errorf("Failed deleting write access check s3://%s/%s, the DeleteObject permission may be missing: (%s)", sb.o.S3Bucket, key, err)
+	}
+	return nil
+}
+
+// candidateRegionForBucket returns the first candidate region from which a HeadBucket
+// succeeds, or an error aggregating the failed lookup and each candidate's failure.
+func candidateRegionForBucket(awsSession *session.Session, awsCreds *credentials.Credentials, bucket string, candidates []string, lookupErr error) (string, error) {
+	failures := []string{lookupErr.Error()}
+	for _, region := range candidates {
+		awsConfig := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(true).WithCredentials(awsCreds)
+		err := headS3Bucket(s3.New(awsSession, awsConfig), bucket)
+		if err == nil {
+			return region, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", region, err))
+	}
+	return "", fmt.Errorf("no candidate region succeeded, %s", strings.Join(failures, "; "))
 }
 
 // Pack writes bytes into a buffer. Once that buffer hits capacity, the data is output to s3.
 // Any error will leave the buffer unmodified.
 func (sb *S3Box) Pack(data []byte) error {
+	_, err := sb.PackWithFlush(data)
+	return err
+}
+
+// PackWithFlush packs like Pack, additionally reporting whether the buffer was flushed
+// to s3 during the call, e.g. for checkpointing upstream offsets at flush boundaries.
+func (sb *S3Box) PackWithFlush(data []byte) (flushed bool, err error) {
 	if sb.isShipped {
-		return errBoxIsShipped
+		return false, errBoxIsShipped
 	}
 
 	sb.mt.Lock()
 	defer sb.mt.Unlock()
+
+	// A row larger than the buffer is still accepted by an empty buffer, otherwise it could never be packed
+	if sb.o.FlushMode == FlushReject && sb.o.NumFiles <= 0 && len(sb.bufferedData) > 0 &&
+		(len(sb.bufferedData)+len(data)+1 > sb.o.BufferSize || sb.recordLimitReached()) {
+		return false, ErrBufferFull
+	}
+
+	var rowHash [sha256.Size]byte
+	if sb.o.DedupeConsecutive {
+		rowHash = sha256.Sum256(data)
+		if sb.hasLastRowHash && rowHash == sb.lastRowHash {
+			return false, nil
+		}
+	}
+
+	var dedupeKey string
+	if sb.o.DedupeKeyFunc != nil {
+		dedupeKey = sb.o.DedupeKeyFunc(data)
+		if _, seen := sb.seenKeys[dedupeKey]; seen {
+			return false, nil
+		}
+	}
+
 	oldBuffer := sb.bufferedData // If write fails, keep buffered data unchanged
-	data = append(data, '\n')    // Append a new line for text-editor readability
+	row := data
+	data = append(data, '\n') // Append a new line for text-editor readability
 	sb.bufferedData = append(sb.bufferedData, data...)
+	sb.bufferedRows++
 
-	// If we're hitting capacity, dump the results to s3.
+	// If we're hitting capacity in bytes or records, dump the results to s3.
 	// If shipping to s3 errors, don't modify the buffer.
-	if len(sb.bufferedData) > sb.o.BufferSize {
+	// When splitting into a fixed number of files, everything is buffered until shipping.
+	if sb.o.FlushMode == FlushInline && sb.o.NumFiles <= 0 && (len(sb.bufferedData) > sb.o.BufferSize || sb.recordLimitReached()) {
 		if err := sb.dumpToS3(); err != nil {
 			sb.bufferedData = oldBuffer
-			return err
+			sb.bufferedRows--
+			return false, err
+		}
+		flushed = true
+	}
+
+	if sb.o.DedupeKeyFunc != nil {
+		if sb.seenKeys == nil {
+			sb.seenKeys = map[string]struct{}{}
 		}
+		sb.seenKeys[dedupeKey] = struct{}{}
 	}
+	if sb.o.DedupeConsecutive {
+		sb.lastRowHash = rowHash
+		sb.hasLastRowHash = true
+	}
+	sb.packedRows++
+	if sb.o.TeeWriter != nil {
+		if _, err := sb.o.TeeWriter.Write(data); err != nil {
+			log.Printf("Failed writing packed row to the TeeWriter: %s\n", err)
+		}
+	}
+	if sb.o.OnRowPacked != nil {
+		sb.o.OnRowPacked(row)
+	}
+	return flushed, nil
+}
 
+// checkFlushed guards against data loss, returning an internal-consistency error unless
+// the buffer is empty and every packed row was written to a data file.
+func (sb *S3Box) checkFlushed() error {
+	if len(sb.bufferedData) > 0 || sb.bufferedRows > 0 || sb.fileRows != sb.packedRows {
+		return fmt.Errorf("internal consistency error: %d bytes (%d rows) remain buffered after flushing, and %d of %d packed rows were written to s3",
+			len(sb.bufferedData), sb.bufferedRows, sb.fileRows, sb.packedRows)
+	}
 	return nil
 }
 
+// recordLimitReached indicates the buffer holds MaxRecordsPerFile rows, if set.
+func (sb *S3Box) recordLimitReached() bool {
+	return sb.o.MaxRecordsPerFile > 0 && sb.bufferedRows >= sb.o.MaxRecordsPerFile
+}
+
 // CreateManifests takes in a manifest key and splits the s3 files across the
 // input number of manifests. If nManifests is greater than the number of generated
 // s3 files, you'll only receive manifests back point
+//
+// If MaxFilesPerManifest is set, the number of manifests is increased as needed
+// such that no manifest references more files than the cap. If FilesPerManifest is
+// set, nManifests is ignored, and as many manifests as needed are created instead.
 func (sb *S3Box) CreateManifests(manifestSlug string, nManifests int) ([]string, error) {
 	sb.mt.Lock()
 	defer sb.mt.Unlock()
@@ -159,6 +635,17 @@ func (sb *S3Box) CreateManifests(manifestSlug string, nManifests int) ([]string,
 	if err := sb.dumpToS3(); err != nil {
 		return nil, err
 	}
+	if err := sb.checkFlushed(); err != nil {
+		return nil, err
+	}
+	if err := sb.compact(); err != nil {
+		return nil, err
+	}
+	if sb.o.VisibilityRetries > 0 || sb.o.VerifyFilesBeforeManifest {
+		if err := sb.verifyFilesVisible(sb.o.VisibilityRetries); err != nil {
+			return nil, err
+		}
+	}
 
 	type entry struct {
 		URL       string `json:"url"`
@@ -168,47 +655,711 @@ func (sb *S3Box) CreateManifests(manifestSlug string, nManifests int) ([]string,
 		Entries []entry `json:"entries"`
 	}
 
-	if nManifests > len(sb.fileLocations) {
-		nManifests = len(sb.fileLocations)
-	}
+	nManifests = sb.manifestCount(nManifests)
 	manifests := make([]entries, nManifests)
 
 	// Evenly distribute the file locations across the manifests
+	assignments := sb.manifestAssignments(nManifests)
 	for i, fileName := range sb.fileLocations {
-		index := i % nManifests
+		mandatory := sb.o.MandatoryFunc == nil || sb.o.MandatoryFunc(fileName)
+		index := assignments[i]
 		manifests[index].Entries = append(manifests[index].Entries, entry{
 			URL:       fileName,
-			Mandatory: true,
+			Mandatory: mandatory,
 		})
 	}
 
 	manifestLocations := make([]string, nManifests)
 	for i, manifest := range manifests {
 		manifestBytes, _ := json.Marshal(manifest)
-		manifestName := fmt.Sprintf("%s_%d.manifest", manifestSlug, i)
-		manifestLocations[i] = manifestName
-		if err := writeToS3(sb.s3Handler, sb.o.S3Bucket, manifestName, manifestBytes, false); err != nil {
-			return nil, err
+		key := sb.manifestKey(manifestSlug, i)
+		location, err := sb.writeManifest(key, manifestBytes)
+		if err == nil && sb.o.VerifyManifestRoundtrip {
+			err = sb.verifyManifest(key, len(manifest.Entries))
 		}
-		log.Printf("Wrote manifest to s3://%s/%s\n", sb.o.S3Bucket, manifestName)
+		if err != nil {
+			return nil, &ManifestUploadError{Written: manifestLocations[:i], Err: err}
+		}
+		manifestLocations[i] = location
 	}
 
 	sb.isShipped = true
 	return manifestLocations, nil
 }
 
+// WriteMetadata writes a <manifestSlug>.meta.json object next to the manifests, recording
+// the load for lineage tracking. The given metadata is written along with the box's
+// file and row counts, which take precedence over any same-named keys. Like manifests,
+// it's written via the ManifestStore, and its location is returned.
+func (sb *S3Box) WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error) {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+
+	record := make(map[string]interface{}, len(metadata)+2)
+	for key, value := range metadata {
+		record[key] = value
+	}
+	record["files"] = len(sb.fileLocations)
+	record["rows"] = sb.fileRows
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encode load metadata, %s", err)
+	}
+	return sb.o.ManifestStore.WriteManifest(fmt.Sprintf("%s%s.meta.json", sb.o.KeyPrefix, manifestSlug), recordBytes)
+}
+
+// writeManifest writes a manifest to the ManifestStore, retrying failures up to MaxManifestRetries times.
+func (sb *S3Box) writeManifest(key string, data []byte) (string, error) {
+	location, err := sb.o.ManifestStore.WriteManifest(key, data)
+	for retry := 1; err != nil && retry <= sb.o.MaxManifestRetries; retry++ {
+		delay := sb.o.Backoff.NextDelay(retry)
+		log.Printf("Failed writing manifest %s, retrying in %s (%d/%d): %s\n", key, delay, retry, sb.o.MaxManifestRetries, err)
+		time.Sleep(delay)
+		location, err = sb.o.ManifestStore.WriteManifest(key, data)
+	}
+	return location, err
+}
+
+// verifyManifest reads back the manifest written under the key, checking it parses
+// and lists the expected number of entries.
+func (sb *S3Box) verifyManifest(key string, nEntries int) error {
+	data, err := sb.o.ManifestStore.(ManifestReader).ReadManifest(key)
+	if err != nil {
+		return err
+	}
+	var manifest struct {
+		Entries []json.RawMessage `json:"entries"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("manifest %s doesn't parse after writing it: %s", key, err)
+	}
+	if len(manifest.Entries) != nEntries {
+		return fmt.Errorf("manifest %s lists %d entries after writing it, rather than %d", key, len(manifest.Entries), nEntries)
+	}
+	return nil
+}
+
+// PlanManifests flushes any buffered data to s3 and returns the keys of the manifests
+// CreateManifests would create for the same inputs, without writing them or shipping the box.
+func (sb *S3Box) PlanManifests(manifestSlug string, nManifests int) ([]string, error) {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+
+	if err := sb.dumpToS3(); err != nil {
+		return nil, err
+	}
+	manifestKeys := make([]string, sb.manifestCount(nManifests))
+	for i := range manifestKeys {
+		manifestKeys[i] = sb.manifestKey(manifestSlug, i)
+	}
+	return manifestKeys, nil
+}
+
+// manifestCount adjusts the requested number of manifests to honor MaxFilesPerManifest,
+// while never exceeding the number of data files.
+func (sb *S3Box) manifestCount(nManifests int) int {
+	if sb.o.FilesPerManifest > 0 {
+		return (len(sb.fileLocations) + sb.o.FilesPerManifest - 1) / sb.o.FilesPerManifest
+	}
+	if sb.o.MaxFilesPerManifest > 0 {
+		// Round up, such that no manifest exceeds the cap
+		minManifests := (len(sb.fileLocations) + sb.o.MaxFilesPerManifest - 1) / sb.o.MaxFilesPerManifest
+		if nManifests < minManifests {
+			nManifests = minManifests
+		}
+	}
+	if nManifests > len(sb.fileLocations) {
+		nManifests = len(sb.fileLocations)
+	}
+	return nManifests
+}
+
+// manifestAssignments returns the index of the manifest each data file is listed in.
+// Files are grouped consecutively with FilesPerManifest, otherwise distributed round-robin, or with BalanceManifestsBySize, greedily assigned
+// largest first to the manifest with the fewest bytes, respecting any MaxFilesPerManifest.
+func (sb *S3Box) manifestAssignments(nManifests int) []int {
+	assignments := make([]int, len(sb.fileLocations))
+	if sb.o.FilesPerManifest > 0 {
+		for i := range assignments {
+			assignments[i] = i / sb.o.FilesPerManifest
+		}
+		return assignments
+	}
+	if !sb.o.BalanceManifestsBySize || len(sb.fileSizes) != len(sb.fileLocations) {
+		for i := range assignments {
+			assignments[i] = i % nManifests
+		}
+		return assignments
+	}
+
+	bySize := filesBySize{files: make([]int, len(sb.fileSizes)), sizes: sb.fileSizes}
+	for i := range bySize.files {
+		bySize.files[i] = i
+	}
+	sort.Stable(bySize)
+	totals := make([]int64, nManifests)
+	counts := make([]int, nManifests)
+	for _, file := range bySize.files {
+		smallest := -1
+		for m := range totals {
+			if sb.o.MaxFilesPerManifest > 0 && counts[m] >= sb.o.MaxFilesPerManifest {
+				continue
+			}
+			if smallest < 0 || totals[m] < totals[smallest] {
+				smallest = m
+			}
+		}
+		assignments[file] = smallest
+		totals[smallest] += sb.fileSizes[file]
+		counts[smallest]++
+	}
+	return assignments
+}
+
+// filesBySize sorts the indices of data files by their sizes, largest first.
+type filesBySize struct {
+	files []int
+	sizes []int64
+}
+
+func (f filesBySize) Len() int           { return len(f.files) }
+func (f filesBySize) Swap(i, j int)      { f.files[i], f.files[j] = f.files[j], f.files[i] }
+func (f filesBySize) Less(i, j int) bool { return f.sizes[f.files[i]] > f.sizes[f.files[j]] }
+
+// manifestKey defines the key of the i-th manifest of a load.
+func (sb *S3Box) manifestKey(manifestSlug string, i int) string {
+	return fmt.Sprintf("%s%s_%d.manifest", sb.o.KeyPrefix, manifestSlug, i)
+}
+
+// verifyFilesVisible checks every data file exists in s3, retrying those not yet visible
+// up to the given number of times. An error names any files still missing.
+func (sb *S3Box) verifyFilesVisible(retries int) error {
+	keys := make([]string, len(sb.fileLocations))
+	for i, fileName := range sb.fileLocations {
+		keys[i] = strings.TrimPrefix(fileName, fmt.Sprintf("s3://%s/", sb.o.S3Bucket))
+	}
+
+	missing, err := sb.missingFiles(keys)
+	for retry := 1; err == nil && len(missing) > 0 && retry <= retries; retry++ {
+		delay := sb.o.Backoff.NextDelay(retry)
+		log.Printf("%d data files aren't yet visible in s3://%s, retrying in %s (%d/%d)\n", len(missing), sb.o.S3Bucket, delay, retry, retries)
+		time.Sleep(delay)
+		missing, err = sb.missingFiles(missing)
+	}
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("data files are missing from s3://%s: %s", sb.o.S3Bucket, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingFiles returns the given keys which don't exist in the bucket.
+func (sb *S3Box) missingFiles(keys []string) ([]string, error) {
+	var missing []string
+	for _, key := range keys {
+		exists, err := headS3Object(sb.s3Handler, sb.o.S3Bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// Flush uploads any buffered data to s3. In FlushReject mode, this must
+// be called whenever Pack returns ErrBufferFull.
+func (sb *S3Box) Flush() error {
+	if sb.isShipped {
+		return errBoxIsShipped
+	}
+
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	return sb.dumpToS3()
+}
+
+// DataFiles flushes any buffered data to s3 and returns the locations of every
+// data file created so far. Unlike CreateManifests, no manifests are written
+// and the box isn't shipped. Like CreateManifests, it errors unless every packed
+// row was written to a data file.
+func (sb *S3Box) DataFiles() ([]string, error) {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+
+	if err := sb.dumpToS3(); err != nil {
+		return nil, err
+	}
+	if err := sb.checkFlushed(); err != nil {
+		return nil, err
+	}
+	files := make([]string, len(sb.fileLocations))
+	copy(files, sb.fileLocations)
+	return files, nil
+}
+
+// FileSizes returns the uploaded size in bytes of every data file created so far,
+// in the same order as their locations. Gzipped files report their compressed size.
+func (sb *S3Box) FileSizes() []int64 {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	sizes := make([]int64, len(sb.fileSizes))
+	copy(sizes, sb.fileSizes)
+	return sizes
+}
+
+// Stats reports the number of data files and rows written to s3 so far. Buffered
+// rows aren't included until flushed.
+func (sb *S3Box) Stats() Stats {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	return Stats{
+		Files: len(sb.fileLocations),
+		Rows:  sb.fileRows,
+	}
+}
+
+// SetFileCounterStart sets the number of the next data file created, e.g. to resume
+// a box's numbering after a crash without colliding with already created keys.
+// Numbering restarts at 0 when the box is reset.
+func (sb *S3Box) SetFileCounterStart(n int) {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	sb.fileCounter = n
+}
+
+// HasData indicates whether any data is buffered or has already been written to s3.
+func (sb *S3Box) HasData() bool {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	return len(sb.bufferedData) > 0 || len(sb.fileLocations) > 0
+}
+
+// Reset discards all buffered data and file locations, readying the box for a new
+// load under a fresh timestamp. Data files already written to s3 are left untouched.
+func (sb *S3Box) Reset() {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	sb.bufferedData = []byte{}
+	sb.bufferedRows = 0
+	sb.fileLocations = nil
+	sb.fileSizes = nil
+	sb.fileRows = 0
+	sb.packedRows = 0
+	sb.fileCounter = 0
+	sb.seenKeys = nil
+	sb.hasLastRowHash = false
+	sb.timestamp = time.Now()
+	sb.isShipped = false
+}
+
+// RotateTimestamp sets a new timestamp for the keys of subsequent data files, giving them
+// a fresh namespace, e.g. for boxes reused across logical loads. The buffer must be empty,
+// e.g. after a Flush. Files already written keep their keys and are still included in
+// manifests.
+func (sb *S3Box) RotateTimestamp() error {
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	if len(sb.bufferedData) > 0 {
+		return errBufferNotFlushed
+	}
+	sb.timestamp = time.Now()
+	return nil
+}
+
+// ReapOrphans deletes data files and manifests under the KeyPrefix last modified
+// longer ago than olderThan, such as those left behind by failed loads, and returns
+// the number of deleted objects. Files of this box's current load are never deleted,
+// nor are any data files it has yet to ship, such as recovered ones or those written
+// before a RotateTimestamp.
+//
+// In-progress loads of other boxes can't be detected, so olderThan must comfortably
+// exceed the longest expected load. Keys not matching the box's naming convention
+// are ignored, as are manifests with slugs other than a Redbox's, dated by their load.
+func (sb *S3Box) ReapOrphans(olderThan time.Duration) (int, error) {
+	sb.mt.Lock()
+	currentLoad := fmt.Sprintf("%s%d_", sb.o.KeyPrefix, sb.timestamp.UnixNano())
+	bucketPrefix := fmt.Sprintf("s3://%s/", sb.o.S3Bucket)
+	activeKeys := make(map[string]bool, len(sb.fileLocations))
+	for _, fileName := range sb.fileLocations {
+		activeKeys[strings.TrimPrefix(fileName, bucketPrefix)] = true
+	}
+	sb.mt.Unlock()
+
+	objects, err := listS3Objects(sb.s3Handler, sb.o.S3Bucket, sb.o.KeyPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var orphans []string
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		if !stagedKeyPattern.MatchString(strings.TrimPrefix(key, sb.o.KeyPrefix)) || strings.HasPrefix(key, currentLoad) || activeKeys[key] {
+			continue
+		}
+		if object.LastModified != nil && object.LastModified.Before(cutoff) {
+			orphans = append(orphans, key)
+		}
+	}
+
+	deleted, err := sb.deleteKeys(orphans)
+	if err != nil {
+		return deleted, err
+	}
+	log.Printf("Reaped %d orphaned files from s3://%s/%s\n", deleted, sb.o.S3Bucket, sb.o.KeyPrefix)
+	return deleted, nil
+}
+
+// deleteKeys deletes the keys from the bucket in batches, returning the number deleted.
+func (sb *S3Box) deleteKeys(keys []string) (int, error) {
+	deleted := 0
+	for len(keys) > 0 {
+		batchSize := len(keys)
+		if batchSize > maxDeleteBatch {
+			batchSize = maxDeleteBatch
+		}
+		if err := deleteS3Objects(sb.s3Handler, sb.o.S3Bucket, keys[:batchSize]); err != nil {
+			return deleted, err
+		}
+		deleted += batchSize
+		keys = keys[batchSize:]
+	}
+	return deleted, nil
+}
+
+// Compact flushes any buffered data to s3 and merges runs of consecutive data files into
+// fewer files of up to MaxObjectSize bytes, replacing their locations. Concatenated gzip
+// files are valid multistream gzip, which the COPY reads like a single stream. The merged
+// files are deleted. Without a MaxObjectSize, nothing is merged.
+func (sb *S3Box) Compact() error {
+	if sb.isShipped {
+		return errBoxIsShipped
+	}
+
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	if err := sb.dumpToS3(); err != nil {
+		return err
+	}
+	return sb.compact()
+}
+
+// compact merges data files as described by Compact, downloading and re-uploading them.
+func (sb *S3Box) compact() error {
+	if sb.o.MaxObjectSize <= 0 || len(sb.fileSizes) != len(sb.fileLocations) {
+		return nil
+	}
+	if sb.o.EncryptionKey != nil {
+		return errCompactEncrypted
+	}
+
+	bucketPrefix := fmt.Sprintf("s3://%s/", sb.o.S3Bucket)
+	var locations []string
+	var sizes []int64
+	var merged []string
+	for start := 0; start < len(sb.fileLocations); {
+		end, total := start+1, sb.fileSizes[start]
+		for end < len(sb.fileLocations) && total+sb.fileSizes[end] <= sb.o.MaxObjectSize {
+			total += sb.fileSizes[end]
+			end++
+		}
+		if end-start == 1 {
+			locations = append(locations, sb.fileLocations[start])
+			sizes = append(sizes, sb.fileSizes[start])
+			start = end
+			continue
+		}
+
+		var body []byte
+		var keys []string
+		for _, fileName := range sb.fileLocations[start:end] {
+			key := strings.TrimPrefix(fileName, bucketPrefix)
+			data, err := getS3Object(sb.s3Handler, sb.o.S3Bucket, key)
+			if err != nil {
+				return err
+			}
+			body = append(body, data...)
+			keys = append(keys, key)
+		}
+		fileKey := sb.nextFileKey()
+		size, err := sb.upload(fileKey, body, false, false)
+		if err != nil {
+			return err
+		}
+		sb.fileCounter++
+		locations = append(locations, bucketPrefix+fileKey)
+		sizes = append(sizes, size)
+		merged = append(merged, keys...)
+		start = end
+	}
+
+	log.Printf("Compacted %d data files into %d in s3://%s\n", len(sb.fileLocations), len(locations), sb.o.S3Bucket)
+	sb.fileLocations = locations
+	sb.fileSizes = sizes
+	// The merged files are no longer referenced, so failing to delete them only leaves orphans
+	if _, err := sb.deleteKeys(merged); err != nil {
+		log.Printf("Failed deleting compacted data files from s3://%s, they're left for ReapOrphans: %s\n", sb.o.S3Bucket, err)
+	}
+	return nil
+}
+
+// RecoverFileLocations lists the data files under the given key prefix, which should
+// include any KeyPrefix, and replaces the box's file locations with them. This lets a
+// process ship data files uploaded by a predecessor which crashed before shipping, e.g.
+// by passing the prefix of that load's keys. Files are ordered by load and file number,
+// and new files are numbered after the recovered ones. Keys not matching the box's
+// naming convention of data files are ignored.
+func (sb *S3Box) RecoverFileLocations(prefix string) error {
+	if sb.isShipped {
+		return errBoxIsShipped
+	}
+
+	objects, err := listS3Objects(sb.s3Handler, sb.o.S3Bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	var files recoveredFiles
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		if !strings.HasPrefix(key, sb.o.KeyPrefix) {
+			continue
+		}
+		match := dataFileKeyPattern.FindStringSubmatch(strings.TrimPrefix(key, sb.o.KeyPrefix))
+		if match == nil {
+			continue
+		}
+		timestamp, _ := strconv.ParseInt(match[1], 10, 64)
+		number, _ := strconv.Atoi(match[3])
+		files = append(files, recoveredFile{key: key, timestamp: timestamp, shardID: match[2], number: number, size: aws.Int64Value(object.Size)})
+	}
+	sort.Sort(files)
+
+	sb.mt.Lock()
+	defer sb.mt.Unlock()
+	sb.fileLocations = make([]string, len(files))
+	sb.fileSizes = make([]int64, len(files))
+	for i, file := range files {
+		sb.fileLocations[i] = fmt.Sprintf("s3://%s/%s", sb.o.S3Bucket, file.key)
+		sb.fileSizes[i] = file.size
+		if file.number >= sb.fileCounter {
+			sb.fileCounter = file.number + 1
+		}
+	}
+	log.Printf("Recovered %d data files from s3://%s/%s\n", len(files), sb.o.S3Bucket, prefix)
+	return nil
+}
+
+// recoveredFile is a data file found by RecoverFileLocations.
+type recoveredFile struct {
+	key       string
+	timestamp int64
+	shardID   string
+	number    int
+	size      int64
+}
+
+// recoveredFiles sorts data files by their load's timestamp, then shard, then file number.
+type recoveredFiles []recoveredFile
+
+func (r recoveredFiles) Len() int      { return len(r) }
+func (r recoveredFiles) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r recoveredFiles) Less(i, j int) bool {
+	if r[i].timestamp != r[j].timestamp {
+		return r[i].timestamp < r[j].timestamp
+	}
+	if r[i].shardID != r[j].shardID {
+		return r[i].shardID < r[j].shardID
+	}
+	return r[i].number < r[j].number
+}
+
 // dumpToS3 ships buffered  data to s3 and increments the index with a clean slate of running data
 func (sb *S3Box) dumpToS3() error {
 	if len(sb.bufferedData) == 0 {
 		return nil
 	}
-	fileNumber := len(sb.fileLocations)
-	fileKey := fmt.Sprintf("%d_%d.gz", sb.timestamp.UnixNano(), fileNumber)
-	if err := writeToS3(sb.s3Handler, sb.o.S3Bucket, fileKey, sb.bufferedData, true); err != nil {
+	if sb.o.NumFiles > 0 {
+		return sb.dumpSplitToS3()
+	}
+	if err := sb.writeFile(sb.bufferedData, sb.bufferedRows); err != nil {
 		return err
 	}
 	sb.bufferedData = []byte{}
-	fileName := fmt.Sprintf("s3://%s/%s", sb.o.S3Bucket, fileKey)
-	sb.fileLocations = append(sb.fileLocations, fileName)
+	sb.bufferedRows = 0
+	return nil
+}
+
+// dumpSplitToS3 evenly splits buffered data into NumFiles files at record boundaries.
+// The files are only recorded, and the flush hooks fired, once all have uploaded. If any
+// fails, those already uploaded are deleted and the buffer is left unchanged.
+func (sb *S3Box) dumpSplitToS3() error {
+	oldFileCounter := sb.fileCounter
+	var files []uploadedFile
+	for _, chunk := range splitRecords(sb.bufferedData, sb.o.NumFiles) {
+		file, err := sb.uploadFile(chunk, bytes.Count(chunk, []byte{'\n'}))
+		if err != nil {
+			sb.fileCounter = oldFileCounter
+			keys := make([]string, len(files))
+			for i, uploaded := range files {
+				keys[i] = uploaded.key
+			}
+			if _, deleteErr := sb.deleteKeys(keys); deleteErr != nil {
+				log.Printf("Failed deleting the partially uploaded split from s3://%s, it's left for ReapOrphans: %s\n", sb.o.S3Bucket, deleteErr)
+			}
+			return err
+		}
+		files = append(files, file)
+	}
+	for _, file := range files {
+		sb.recordFile(file)
+	}
+	sb.bufferedData = []byte{}
+	sb.bufferedRows = 0
 	return nil
 }
+
+// splitRecords splits newline-delimited records into at most n chunks of roughly equal size.
+// Fewer chunks are returned only if there are fewer than n records.
+func splitRecords(data []byte, n int) [][]byte {
+	var chunks [][]byte
+	for i := n; i > 0 && len(data) > 0; i-- {
+		// Cut at the first record boundary past an even share of the remaining data
+		cut := len(data)
+		if i > 1 {
+			if boundary := bytes.IndexByte(data[(len(data)-1)/i:], '\n'); boundary >= 0 {
+				cut = (len(data)-1)/i + boundary + 1
+			}
+		}
+		chunks = append(chunks, data[:cut])
+		data = data[cut:]
+	}
+	return chunks
+}
+
+// nextFileKey returns the key of the next data file created, numbered by the fileCounter.
+func (sb *S3Box) nextFileKey() string {
+	extension := "gz"
+	if sb.o.Debug {
+		extension = "json"
+	}
+	shard := sb.o.ShardID
+	if sb.keySuffix != "" {
+		if shard != "" {
+			shard += "-"
+		}
+		shard += sb.keySuffix
+	}
+	if shard != "" {
+		shard += "_"
+	}
+	return fmt.Sprintf("%s%d_%s%d.%s", sb.o.KeyPrefix, sb.timestamp.UnixNano(), shard, sb.fileCounter, extension)
+}
+
+// writeFile uploads a single data file of the given rows to s3 and records its location.
+func (sb *S3Box) writeFile(data []byte, rows int) error {
+	file, err := sb.uploadFile(data, rows)
+	if err != nil {
+		return err
+	}
+	sb.recordFile(file)
+	return nil
+}
+
+// uploadedFile is a data file uploaded to s3, but not yet recorded among the box's files.
+type uploadedFile struct {
+	key   string
+	size  int64
+	rows  int
+	stats FlushStats
+}
+
+// uploadFile uploads data under the next data file key, advancing the fileCounter.
+func (sb *S3Box) uploadFile(data []byte, rows int) (uploadedFile, error) {
+	fileKey := sb.nextFileKey()
+
+	var stats FlushStats
+	if sb.o.OnFlush != nil {
+		size := int64(len(data))
+		if !sb.o.Debug {
+			var err error
+			if size, err = compressedSize(data); err != nil {
+				return uploadedFile{}, err
+			}
+		}
+		stats = FlushStats{
+			FileKey:         fileKey,
+			Rows:            rows,
+			Bytes:           len(data),
+			CompressedBytes: size,
+		}
+	}
+
+	size, err := sb.upload(fileKey, data, !sb.o.Debug, sb.o.EncryptionKey != nil)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	sb.fileCounter++
+	return uploadedFile{key: fileKey, size: size, rows: rows, stats: stats}, nil
+}
+
+// recordFile adds an uploaded data file to those the box ships, firing the flush hooks.
+func (sb *S3Box) recordFile(file uploadedFile) {
+	sb.fileLocations = append(sb.fileLocations, fmt.Sprintf("s3://%s/%s", sb.o.S3Bucket, file.key))
+	sb.fileSizes = append(sb.fileSizes, file.size)
+	sb.fileRows += file.rows
+
+	if sb.o.OnRowsFlushed != nil {
+		sb.o.OnRowsFlushed(file.rows)
+	}
+	if sb.o.OnFlush != nil {
+		sb.o.OnFlush(file.stats)
+	}
+	if sb.o.MaxFilesBeforeShip > 0 && len(sb.fileLocations) >= sb.o.MaxFilesBeforeShip && sb.o.OnShipRecommended != nil {
+		sb.o.OnShipRecommended(len(sb.fileLocations))
+	}
+}
+
+// upload writes data to the given key, retrying failures up to UploadRetries times,
+// and returns the number of bytes uploaded.
+func (sb *S3Box) upload(key string, data []byte, gzip, encrypted bool) (int64, error) {
+	size, err := sb.uploadOnce(key, data, gzip, encrypted)
+	for retry := 1; err != nil && retry <= sb.o.UploadRetries; retry++ {
+		delay := sb.o.Backoff.NextDelay(retry)
+		log.Printf("Failed writing s3://%s/%s, retrying in %s (%d/%d): %s\n", sb.o.S3Bucket, key, delay, retry, sb.o.UploadRetries, err)
+		time.Sleep(delay)
+		size, err = sb.uploadOnce(key, data, gzip, encrypted)
+	}
+	return size, err
+}
+
+// uploadOnce makes a single attempt at writing data to the given key with the Uploader,
+// optionally encrypting it with the EncryptionKey after compression. Data is compressed
+// up front when encrypting or writing GzipHeaders.
+func (sb *S3Box) uploadOnce(key string, data []byte, gzip, encrypted bool) (int64, error) {
+	body := data
+	var err error
+	if gzip && (encrypted || sb.o.GzipHeaders) {
+		if sb.o.GzipHeaders {
+			body, err = gzipBytesWithHeader(body, strings.TrimSuffix(key, ".gz"), sb.timestamp)
+		} else {
+			body, err = gzipBytes(body)
+		}
+		if err != nil {
+			return 0, err
+		}
+		gzip = false
+	}
+	if encrypted {
+		if body, err = encrypt(sb.o.EncryptionKey, body); err != nil {
+			return 0, err
+		}
+	}
+
+	return sb.o.Uploader.Upload(sb.o.S3Bucket, key, body, gzip)
+}
@@ -3,5 +3,12 @@ package s3box
 // API establishes an S3Box interface
 type API interface {
 	Pack(data []byte) error
+	Flush() error
 	CreateManifests(manifestSlug string, nManifests int) ([]string, error)
+	PlanManifests(manifestSlug string, nManifests int) ([]string, error)
+	WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error)
+	DataFiles() ([]string, error)
+	Stats() Stats
+	HasData() bool
+	Reset()
 }
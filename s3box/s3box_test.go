@@ -1,13 +1,24 @@
 package s3box
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,12 +37,12 @@ func getRegionForBucketFail(bucket string) (string, error) {
 	return "", fmt.Errorf("failed getting bucket location")
 }
 
-func writeToS3Success(s3Handler *s3.S3, schema, table string, input []byte, gzip bool) error {
-	return nil
+func writeToS3Success(s3Handler *s3.S3, schema, table string, input []byte, gzip bool) (int64, error) {
+	return int64(len(input)), nil
 }
 
-func writeToS3Fail(s3Handler *s3.S3, schema, table string, input []byte, gzip bool) error {
-	return fmt.Errorf("failed writing to s3")
+func writeToS3Fail(s3Handler *s3.S3, schema, table string, input []byte, gzip bool) (int64, error) {
+	return 0, fmt.Errorf("failed writing to s3")
 }
 
 func TestMain(m *testing.M) {
@@ -199,3 +210,1801 @@ func TestCreatesCorrectNumberOfManifests(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(nFiles, len(manifestLocations))
 }
+
+func TestDataFilesFlushesWithoutShipping(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+	assert.NoError(sb.Pack(data))
+	files, err := sb.DataFiles()
+	assert.NoError(err)
+	assert.Equal(1, len(files))
+	assert.Equal(0, len(sb.bufferedData))
+
+	// The box remains open for further packing
+	assert.NoError(sb.Pack(data))
+}
+
+func TestPackAndFlushHooks(t *testing.T) {
+	assert := assert.New(t)
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+
+	var packedRows [][]byte
+	var flushedCounts []int
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		BufferSize:    3 * (len(data) + 1), // The fourth row overflows the buffer
+		OnRowPacked:   func(row []byte) { packedRows = append(packedRows, row) },
+		OnRowsFlushed: func(count int) { flushedCounts = append(flushedCounts, count) },
+	})
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	assert.Equal(3, len(packedRows))
+	assert.Equal(data, packedRows[0])
+	assert.Equal(0, len(flushedCounts))
+
+	assert.NoError(sb.Pack(data))
+	assert.Equal(4, len(packedRows))
+	assert.Equal([]int{4}, flushedCounts)
+
+	// A failed flush neither reports the row as packed nor as flushed
+	assert.NoError(sb.Pack(data))
+	writeToS3 = writeToS3Fail
+	_, err = sb.CreateManifests("test", 1)
+	writeToS3 = writeToS3Success
+	assert.Error(err)
+	assert.Equal(5, len(packedRows))
+	assert.Equal([]int{4}, flushedCounts)
+
+	_, err = sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal([]int{4, 1}, flushedCounts)
+}
+
+func TestHasData(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+	})
+	assert.NoError(err)
+	assert.False(sb.HasData())
+
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+	assert.NoError(sb.Pack(data))
+	assert.True(sb.HasData())
+
+	// Flushed data still counts
+	_, err = sb.DataFiles()
+	assert.NoError(err)
+	assert.True(sb.HasData())
+}
+
+func TestOnFlushReportsCompressedSize(t *testing.T) {
+	assert := assert.New(t)
+	var flushes []FlushStats
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		OnFlush:     func(stats FlushStats) { flushes = append(flushes, stats) },
+	})
+	assert.NoError(err)
+
+	// Highly repetitive data compresses well
+	data, _ := json.Marshal(map[string]interface{}{"id": "1234", "value": strings.Repeat("a", 1000)})
+	nRows := 10
+	for i := 0; i < nRows; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	_, err = sb.DataFiles()
+	assert.NoError(err)
+
+	assert.Equal(1, len(flushes))
+	assert.Equal(nRows, flushes[0].Rows)
+	assert.Equal(nRows*(len(data)+1), flushes[0].Bytes)
+	assert.True(flushes[0].CompressedBytes > 0)
+	assert.True(flushes[0].CompressedBytes < int64(flushes[0].Bytes))
+	assert.Equal(strings.TrimPrefix(sb.fileLocations[0], fmt.Sprintf("s3://%s/", s3Bucket)), flushes[0].FileKey)
+}
+
+func TestMaxFilesPerManifest(t *testing.T) {
+	assert := assert.New(t)
+	var manifestSizes []int
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		var manifest struct {
+			Entries []interface{} `json:"entries"`
+		}
+		assert.NoError(json.Unmarshal(data, &manifest))
+		manifestSizes = append(manifestSizes, len(manifest.Entries))
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:            s3Bucket,
+		AWSKey:              awsKey,
+		AWSPassword:         awsPassword,
+		MaxFilesPerManifest: 3,
+	})
+	assert.NoError(err)
+
+	// Artificially add some file locations
+	nFiles := 20
+	for i := 0; i < nFiles; i++ {
+		sb.fileLocations = append(sb.fileLocations, fmt.Sprintf("test_files_%d.json.gz", i))
+	}
+
+	// Asking for 2 manifests would put 10 files in each, so 7 are created instead
+	manifests, err := sb.CreateManifests("test", 2)
+	assert.NoError(err)
+	assert.Equal(7, len(manifests))
+	assert.Equal([]int{3, 3, 3, 3, 3, 3, 2}, manifestSizes)
+
+	// Requesting more manifests than the cap requires is still honored
+	sb.isShipped = false // Hack to override erroring if the box has already shipped
+	manifestSizes = nil
+	manifests, err = sb.CreateManifests("test", 10)
+	assert.NoError(err)
+	assert.Equal(10, len(manifests))
+	for _, size := range manifestSizes {
+		assert.Equal(2, size)
+	}
+}
+
+func TestFilesPerManifest(t *testing.T) {
+	assert := assert.New(t)
+	var entries [][]string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		var manifest struct {
+			Entries []struct {
+				URL string `json:"url"`
+			} `json:"entries"`
+		}
+		assert.NoError(json.Unmarshal(data, &manifest))
+		var urls []string
+		for _, entry := range manifest.Entries {
+			urls = append(urls, entry.URL)
+		}
+		entries = append(entries, urls)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:         s3Bucket,
+		AWSKey:           awsKey,
+		AWSPassword:      awsPassword,
+		FilesPerManifest: 4,
+	})
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		sb.fileLocations = append(sb.fileLocations, fmt.Sprintf("test_files_%d.json.gz", i))
+	}
+
+	// The requested number of manifests is ignored, consecutive files filling each manifest
+	manifests, err := sb.CreateManifests("test", 2)
+	assert.NoError(err)
+	assert.Equal(3, len(manifests))
+	assert.Equal([][]string{
+		{"test_files_0.json.gz", "test_files_1.json.gz", "test_files_2.json.gz", "test_files_3.json.gz"},
+		{"test_files_4.json.gz", "test_files_5.json.gz", "test_files_6.json.gz", "test_files_7.json.gz"},
+		{"test_files_8.json.gz", "test_files_9.json.gz"},
+	}, entries)
+}
+
+func TestMandatoryFunc(t *testing.T) {
+	assert := assert.New(t)
+	var manifest []byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		manifest = data
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		MandatoryFunc: func(fileURL string) bool {
+			return !strings.Contains(fileURL, "partial")
+		},
+	})
+	assert.NoError(err)
+	sb.fileLocations = []string{"s3://bucket/core_0.gz", "s3://bucket/partial_1.gz"}
+
+	_, err = sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal(`{"entries":[{"url":"s3://bucket/core_0.gz","mandatory":true},{"url":"s3://bucket/partial_1.gz","mandatory":false}]}`, string(manifest))
+}
+
+func TestTeeWriter(t *testing.T) {
+	assert := assert.New(t)
+	var uploaded []byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		uploaded = append(uploaded, data...)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	var tee bytes.Buffer
+	sb, err := NewS3Box(Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		MaxRecordsPerFile: 2,
+		TeeWriter:         &tee,
+	})
+	assert.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(sb.Pack([]byte(fmt.Sprintf(`{"row":%d}`, i))))
+	}
+	_, err = sb.DataFiles()
+	assert.NoError(err)
+
+	// The tee holds exactly the bytes staged across all files
+	assert.Equal(string(uploaded), tee.String())
+	assert.Equal("{\"row\":0}\n{\"row\":1}\n{\"row\":2}\n{\"row\":3}\n{\"row\":4}\n", tee.String())
+}
+
+func TestDebugWritesUncompressedJSON(t *testing.T) {
+	assert := assert.New(t)
+	var keys []string
+	var compressed []bool
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		keys = append(keys, key)
+		compressed = append(compressed, gzip)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		Debug:       true,
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+	assert.NoError(sb.Pack(data))
+	_, err = sb.DataFiles()
+	assert.NoError(err)
+
+	assert.Equal(1, len(keys))
+	assert.True(strings.HasSuffix(keys[0], ".json"))
+	assert.False(compressed[0])
+	assert.True(strings.HasSuffix(sb.fileLocations[0], ".json"))
+}
+
+func TestReset(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+	assert.NoError(sb.Pack(data))
+	_, err = sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal(sb.Pack(data), errBoxIsShipped)
+
+	timestamp := sb.timestamp
+	sb.Reset()
+	assert.False(sb.HasData())
+	assert.True(sb.timestamp.After(timestamp))
+	assert.NoError(sb.Pack(data))
+	manifests, err := sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal(1, len(manifests))
+	assert.Equal(1, len(sb.fileLocations))
+}
+
+func TestReapOrphans(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		KeyPrefix:   "staging/",
+	})
+	assert.NoError(err)
+
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now()
+	currentLoad := fmt.Sprintf("staging/%d_0.gz", sb.timestamp.UnixNano())
+	pages := [][]*s3.Object{
+		{
+			{Key: aws.String("staging/1000_0.gz"), LastModified: &old},
+			{Key: aws.String("staging/1000_1.gz"), LastModified: &old},
+			{Key: aws.String("staging/schema_table_2016-01-01T00:00:00Z_0.manifest"), LastModified: &old},
+			{Key: aws.String("staging/schema_table_2016-01-01T00:00:00-07:00_1.manifest"), LastModified: &old},
+			{Key: aws.String("staging/report_1.manifest"), LastModified: &old},                                  // Not a Redbox manifest
+			{Key: aws.String("staging/other/schema_table_2016-01-01T00:00:00Z_0.manifest"), LastModified: &old}, // Nested deeper
+		},
+		{
+			{Key: aws.String("staging/2000_0.json"), LastModified: &recent}, // Too recent
+			{Key: aws.String("staging/notes.txt"), LastModified: &old},      // Not a staged file
+			{Key: aws.String(currentLoad), LastModified: &old},              // Part of the active load
+		},
+	}
+	listS3ObjectsPage = func(s3Handler *s3.S3, bucket, prefix, token string) ([]*s3.Object, string, error) {
+		assert.Equal(s3Bucket, bucket)
+		assert.Equal("staging/", prefix)
+		if token == "" {
+			return pages[0], "page2", nil
+		}
+		assert.Equal("page2", token)
+		return pages[1], "", nil
+	}
+	var deletedKeys []string
+	deleteS3Objects = func(s3Handler *s3.S3, bucket string, keys []string) error {
+		deletedKeys = append(deletedKeys, keys...)
+		return nil
+	}
+	defer func() {
+		listS3ObjectsPage = listS3ObjectsPageProd
+		deleteS3Objects = deleteS3ObjectsProd
+	}()
+
+	deleted, err := sb.ReapOrphans(24 * time.Hour)
+	assert.NoError(err)
+	assert.Equal(4, deleted)
+	assert.Equal([]string{
+		"staging/1000_0.gz",
+		"staging/1000_1.gz",
+		"staging/schema_table_2016-01-01T00:00:00Z_0.manifest",
+		"staging/schema_table_2016-01-01T00:00:00-07:00_1.manifest",
+	}, deletedKeys)
+}
+
+func TestReapOrphansSkipsRecoveredFiles(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		KeyPrefix:   "staging/",
+	})
+	assert.NoError(err)
+
+	// Recovered files carry their predecessor's timestamp, and are as old as its load
+	old := time.Now().Add(-48 * time.Hour)
+	objects := []*s3.Object{
+		{Key: aws.String("staging/1000_0.gz"), LastModified: &old},
+		{Key: aws.String("staging/1000_1.gz"), LastModified: &old},
+		{Key: aws.String("staging/900_0.gz"), LastModified: &old},
+	}
+	listS3ObjectsPage = func(s3Handler *s3.S3, bucket, prefix, token string) ([]*s3.Object, string, error) {
+		var listed []*s3.Object
+		for _, object := range objects {
+			if strings.HasPrefix(aws.StringValue(object.Key), prefix) {
+				listed = append(listed, object)
+			}
+		}
+		return listed, "", nil
+	}
+	var deletedKeys []string
+	deleteS3Objects = func(s3Handler *s3.S3, bucket string, keys []string) error {
+		deletedKeys = append(deletedKeys, keys...)
+		return nil
+	}
+	defer func() {
+		listS3ObjectsPage = listS3ObjectsPageProd
+		deleteS3Objects = deleteS3ObjectsProd
+	}()
+
+	assert.NoError(sb.RecoverFileLocations("staging/1000_"))
+	deleted, err := sb.ReapOrphans(24 * time.Hour)
+	assert.NoError(err)
+	assert.Equal(1, deleted)
+	assert.Equal([]string{"staging/900_0.gz"}, deletedKeys)
+}
+func TestKeyPrefix(t *testing.T) {
+	assert := assert.New(t)
+	var keys []string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		keys = append(keys, key)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		KeyPrefix:   "staging/",
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+	assert.NoError(sb.Pack(data))
+	manifests, err := sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal([]string{"staging/test_0.manifest"}, manifests)
+	assert.Equal(2, len(keys))
+	for _, key := range keys {
+		assert.True(strings.HasPrefix(key, "staging/"))
+	}
+	assert.Equal(fmt.Sprintf("s3://%s/%s", s3Bucket, keys[0]), sb.fileLocations[0])
+}
+
+func TestFixedNumberOfFiles(t *testing.T) {
+	assert := assert.New(t)
+	var uploads [][]byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		if strings.HasSuffix(key, ".gz") {
+			uploads = append(uploads, data)
+		}
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	for _, nRows := range []int{4, 10, 1000} {
+		uploads = nil
+		sb, err := NewS3Box(Options{
+			S3Bucket:    s3Bucket,
+			AWSKey:      awsKey,
+			AWSPassword: awsPassword,
+			BufferSize:  10, // Ignored when splitting into a fixed number of files
+			NumFiles:    4,
+		})
+		assert.NoError(err)
+
+		var expected []byte
+		for i := 0; i < nRows; i++ {
+			data, _ := json.Marshal(map[string]interface{}{"id": i})
+			assert.NoError(sb.Pack(data))
+			expected = append(expected, append(data, '\n')...)
+		}
+		assert.Equal(0, len(sb.fileLocations))
+
+		_, err = sb.CreateManifests("test", 1)
+		assert.NoError(err)
+		assert.Equal(4, len(sb.fileLocations))
+		assert.Equal(4, len(uploads))
+
+		// Files split at record boundaries and together hold all the data
+		var actual []byte
+		for _, upload := range uploads {
+			assert.Equal(byte('\n'), upload[len(upload)-1])
+			actual = append(actual, upload...)
+		}
+		assert.Equal(expected, actual)
+	}
+}
+
+func TestFixedNumberOfFilesFailedUpload(t *testing.T) {
+	assert := assert.New(t)
+	var uploaded, deleted []string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		if len(uploaded) == 2 {
+			return 0, fmt.Errorf("upload failed")
+		}
+		uploaded = append(uploaded, key)
+		return int64(len(data)), nil
+	}
+	deleteS3Objects = func(s3Handler *s3.S3, bucket string, keys []string) error {
+		deleted = append(deleted, keys...)
+		return nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+		deleteS3Objects = deleteS3ObjectsProd
+	}()
+
+	flushedRows := 0
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		NumFiles:      4,
+		OnRowsFlushed: func(rows int) { flushedRows += rows },
+	})
+	assert.NoError(err)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 8; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+
+	// The files uploaded before the failure are deleted, and none are recorded
+	assert.Error(sb.Flush())
+	assert.Equal(uploaded, deleted)
+	assert.Equal(0, flushedRows)
+	assert.Equal(0, len(sb.fileLocations))
+	assert.Equal(8, sb.bufferedRows)
+
+	// Retrying reuses the same keys, uploading the whole split
+	writeToS3 = writeToS3Success
+	assert.NoError(sb.Flush())
+	assert.Equal(8, flushedRows)
+	assert.Equal(4, len(sb.fileLocations))
+	assert.Equal(fmt.Sprintf("s3://%s/%s", s3Bucket, uploaded[0]), sb.fileLocations[0])
+}
+
+func TestSplitRecordsWithFewRecords(t *testing.T) {
+	assert := assert.New(t)
+	chunks := splitRecords([]byte("{}\n{}\n"), 4)
+	assert.Equal([][]byte{[]byte("{}\n"), []byte("{}\n")}, chunks)
+}
+
+func TestLookupRegion(t *testing.T) {
+	assert := assert.New(t)
+	var usedLookupRegion string
+	GetRegionForBucketFrom = func(bucket, lookupRegion string) (string, error) {
+		usedLookupRegion = lookupRegion
+		return "us-gov-west-1", nil
+	}
+	defer func() {
+		GetRegionForBucketFrom = getRegionForBucketFromProd
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:     s3Bucket,
+		LookupRegion: "us-gov-west-1",
+		AWSKey:       awsKey,
+		AWSPassword:  awsPassword,
+	})
+	assert.NoError(err)
+	assert.Equal("us-gov-west-1", usedLookupRegion)
+	assert.Equal("us-gov-west-1", sb.o.S3Region)
+
+	// The lookup client is built in the resolved region
+	assert.Equal("us-gov-west-1", aws.StringValue(newLookupClient(resolveLookupRegion("us-gov-west-1")).Config.Region))
+}
+
+func TestCandidateRegions(t *testing.T) {
+	assert := assert.New(t)
+	GetRegionForBucket = getRegionForBucketFail
+	var triedRegions []string
+	headS3Bucket = func(s3Handler *s3.S3, bucket string) error {
+		region := aws.StringValue(s3Handler.Config.Region)
+		triedRegions = append(triedRegions, region)
+		if region != "eu-west-1" {
+			return fmt.Errorf("301 moved permanently")
+		}
+		return nil
+	}
+	defer func() {
+		GetRegionForBucket = getRegionForBucketSuccess
+		headS3Bucket = headS3BucketProd
+	}()
+
+	options := Options{
+		S3Bucket:         s3Bucket,
+		AWSKey:           awsKey,
+		AWSPassword:      awsPassword,
+		CandidateRegions: []string{"us-east-1", "eu-west-1", "ap-south-1"},
+	}
+	sb, err := NewS3Box(options)
+	assert.NoError(err)
+	assert.Equal("eu-west-1", sb.o.S3Region)
+	assert.Equal([]string{"us-east-1", "eu-west-1"}, triedRegions)
+
+	// Construction only fails once every candidate failed, reporting each failure
+	options.CandidateRegions = []string{"us-east-1", "ap-south-1"}
+	_, err = NewS3Box(options)
+	assert.Error(err)
+	assert.Contains(err.Error(), "us-east-1: 301 moved permanently")
+	assert.Contains(err.Error(), "ap-south-1: 301 moved permanently")
+}
+
+func TestRegionForLocationConstraint(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("us-east-1", regionForLocationConstraint(nil))
+	assert.Equal("us-east-1", regionForLocationConstraint(aws.String("")))
+	assert.Equal("eu-west-1", regionForLocationConstraint(aws.String("EU")))
+	assert.Equal("ap-southeast-2", regionForLocationConstraint(aws.String("ap-southeast-2")))
+}
+
+func TestResolveLookupRegion(t *testing.T) {
+	assert := assert.New(t)
+	envRegion, envDefaultRegion := os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")
+	defer func() {
+		os.Setenv("AWS_REGION", envRegion)
+		os.Setenv("AWS_DEFAULT_REGION", envDefaultRegion)
+	}()
+
+	os.Setenv("AWS_REGION", "")
+	os.Setenv("AWS_DEFAULT_REGION", "")
+	assert.Equal(defaultLookupRegion, resolveLookupRegion(""))
+
+	os.Setenv("AWS_DEFAULT_REGION", "cn-north-1")
+	assert.Equal("cn-north-1", resolveLookupRegion(""))
+
+	os.Setenv("AWS_REGION", "us-gov-west-1")
+	assert.Equal("us-gov-west-1", resolveLookupRegion(""))
+
+	assert.Equal("eu-west-1", resolveLookupRegion("eu-west-1"))
+}
+
+func TestSharedSession(t *testing.T) {
+	assert := assert.New(t)
+	sharedSession := session.New()
+	var boxes []*S3Box
+	for i := 0; i < 2; i++ {
+		sb, err := NewS3Box(Options{
+			S3Bucket:    s3Bucket,
+			AWSKey:      awsKey,
+			AWSPassword: awsPassword,
+			Session:     sharedSession,
+		})
+		assert.NoError(err)
+		boxes = append(boxes, sb)
+	}
+
+	// Both boxes' clients share the session's HTTP client and connection pool
+	assert.True(boxes[0].s3Handler.Config.HTTPClient == sharedSession.Config.HTTPClient)
+	assert.True(boxes[1].s3Handler.Config.HTTPClient == sharedSession.Config.HTTPClient)
+}
+
+func TestFlushRejectMode(t *testing.T) {
+	assert := assert.New(t)
+	data, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "id": "1234"})
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  2 * (len(data) + 1),
+		FlushMode:   FlushReject,
+	})
+	assert.NoError(err)
+
+	// Packs filling the buffer succeed without flushing
+	assert.NoError(sb.Pack(data))
+	assert.NoError(sb.Pack(data))
+	assert.Equal(0, len(sb.fileLocations))
+
+	// Overflowing the buffer is rejected rather than flushed
+	assert.Equal(ErrBufferFull, sb.Pack(data))
+	assert.Equal(2*(len(data)+1), len(sb.bufferedData))
+	assert.Equal(0, len(sb.fileLocations))
+
+	// Once the caller flushes, packing resumes
+	assert.NoError(sb.Flush())
+	assert.Equal(1, len(sb.fileLocations))
+	assert.Equal(0, len(sb.bufferedData))
+	assert.NoError(sb.Pack(data))
+
+	// Rows larger than the buffer are accepted by an empty buffer
+	assert.NoError(sb.Flush())
+	large := make([]byte, 3*len(data))
+	assert.NoError(sb.Pack(large))
+	assert.Equal(ErrBufferFull, sb.Pack(data))
+}
+
+func TestShipRecommendedAfterMaxFiles(t *testing.T) {
+	assert := assert.New(t)
+	var recommendations []int
+	sb, err := NewS3Box(Options{
+		S3Bucket:           s3Bucket,
+		AWSKey:             awsKey,
+		AWSPassword:        awsPassword,
+		BufferSize:         1,
+		MaxFilesBeforeShip: 3,
+		OnShipRecommended:  func(numFiles int) { recommendations = append(recommendations, numFiles) },
+	})
+	assert.NoError(err)
+
+	// Every pack overflows the single byte buffer, creating a file
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 2; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	assert.Empty(recommendations)
+	for i := 0; i < 2; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	assert.Equal([]int{3, 4}, recommendations)
+
+	sb.Reset()
+	assert.NoError(sb.Pack(data))
+	assert.Equal([]int{3, 4}, recommendations)
+}
+
+func TestPlanManifestsAndStats(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  1,
+		KeyPrefix:   "redbox/",
+	})
+	assert.NoError(err)
+	assert.Equal(Stats{}, sb.Stats())
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	nRows := 3
+	for i := 0; i < nRows; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	assert.Equal(Stats{Files: nRows, Rows: nRows}, sb.Stats())
+
+	planned, err := sb.PlanManifests("slug", 5)
+	assert.NoError(err)
+	assert.Equal([]string{"redbox/slug_0.manifest", "redbox/slug_1.manifest", "redbox/slug_2.manifest"}, planned)
+	assert.False(sb.isShipped)
+
+	created, err := sb.CreateManifests("slug", 5)
+	assert.NoError(err)
+	assert.Equal(planned, created)
+
+	sb.Reset()
+	assert.Equal(Stats{}, sb.Stats())
+}
+
+func TestUploadRetries(t *testing.T) {
+	assert := assert.New(t)
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+	attempts := 0
+	writeToS3 = func(s3Handler *s3.S3, bucket, fileKey string, data []byte, gzip bool) (int64, error) {
+		attempts++
+		if attempts < 3 {
+			return 0, fmt.Errorf("failed writing to s3")
+		}
+		return int64(len(data)), nil
+	}
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		UploadRetries: 2,
+		Backoff:       ConstantBackoff(time.Millisecond),
+	})
+	assert.NoError(err)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(sb.Pack(data))
+	assert.NoError(sb.Flush())
+	assert.Equal(3, attempts)
+	assert.Equal(1, len(sb.fileLocations))
+
+	// Retries are exhausted
+	attempts = 0
+	sb.o.UploadRetries = 1
+	assert.NoError(sb.Pack(data))
+	assert.Error(sb.Flush())
+	assert.Equal(2, attempts)
+	assert.Equal(1, len(sb.fileLocations))
+}
+
+func TestMaxRecordsPerFile(t *testing.T) {
+	assert := assert.New(t)
+	var flushedRows []int
+	sb, err := NewS3Box(Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		MaxRecordsPerFile: 3,
+		OnRowsFlushed:     func(count int) { flushedRows = append(flushedRows, count) },
+	})
+	assert.NoError(err)
+
+	// Rows are tiny relative to the default buffer, so only the record count triggers flushes
+	var rows [][]byte
+	for i := 0; i < 8; i++ {
+		data, _ := json.Marshal(map[string]interface{}{"id": i})
+		rows = append(rows, data)
+		assert.NoError(sb.Pack(data))
+	}
+	assert.Equal([]int{3, 3}, flushedRows)
+	assert.Equal(2, sb.bufferedRows)
+	assert.Equal(string(rows[6])+"\n"+string(rows[7])+"\n", string(sb.bufferedData))
+
+	_, err = sb.DataFiles()
+	assert.NoError(err)
+	assert.Equal([]int{3, 3, 2}, flushedRows)
+
+	// In FlushReject mode, the record limit rejects packs instead
+	sb.Reset()
+	sb.o.FlushMode = FlushReject
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(rows[i]))
+	}
+	assert.Equal(ErrBufferFull, sb.Pack(rows[3]))
+	assert.NoError(sb.Flush())
+	assert.NoError(sb.Pack(rows[3]))
+}
+
+func TestSetFileCounterStart(t *testing.T) {
+	assert := assert.New(t)
+	var keys []string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		keys = append(keys, key)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  1,
+	})
+	assert.NoError(err)
+
+	sb.SetFileCounterStart(7)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(sb.Pack(data))
+	assert.NoError(sb.Pack(data))
+	ts := sb.timestamp.UnixNano()
+	assert.Equal([]string{fmt.Sprintf("%d_7.gz", ts), fmt.Sprintf("%d_8.gz", ts)}, keys)
+	assert.Equal(2, len(sb.fileLocations))
+
+	// A reset restarts the numbering
+	sb.Reset()
+	assert.NoError(sb.Pack(data))
+	assert.Equal(fmt.Sprintf("%d_0.gz", sb.timestamp.UnixNano()), keys[2])
+}
+
+func TestLocalManifestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "manifests")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		BufferSize:    1,
+		KeyPrefix:     "redbox/",
+		ManifestStore: LocalManifestStore{Dir: dir},
+		// Local manifests can be read back too
+		VerifyManifestRoundtrip: true,
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	manifests, err := sb.CreateManifests("test", 2)
+	assert.NoError(err)
+	assert.Equal(2, len(manifests))
+
+	var urls []string
+	for i, manifestPath := range manifests {
+		assert.Equal(filepath.Join(dir, "redbox", fmt.Sprintf("test_%d.manifest", i)), manifestPath)
+
+		manifestData, err := ioutil.ReadFile(manifestPath)
+		assert.NoError(err)
+		var manifest struct {
+			Entries []struct {
+				URL       string `json:"url"`
+				Mandatory bool   `json:"mandatory"`
+			} `json:"entries"`
+		}
+		assert.NoError(json.Unmarshal(manifestData, &manifest))
+		for _, entry := range manifest.Entries {
+			assert.True(entry.Mandatory)
+			urls = append(urls, entry.URL)
+		}
+	}
+	// Files are distributed across manifests in turn
+	assert.Equal([]string{sb.fileLocations[0], sb.fileLocations[2], sb.fileLocations[1]}, urls)
+}
+
+func TestDedupeKeyFunc(t *testing.T) {
+	assert := assert.New(t)
+	var packed []string
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		DedupeKeyFunc: func(row []byte) string {
+			var parsed struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(row, &parsed)
+			return parsed.ID
+		},
+		OnRowPacked: func(row []byte) { packed = append(packed, string(row)) },
+	})
+	assert.NoError(err)
+
+	first, _ := json.Marshal(map[string]interface{}{"id": "1", "value": "a"})
+	duplicate, _ := json.Marshal(map[string]interface{}{"id": "1", "value": "b"})
+	second, _ := json.Marshal(map[string]interface{}{"id": "2", "value": "c"})
+	for _, row := range [][]byte{first, duplicate, second, first} {
+		assert.NoError(sb.Pack(row))
+	}
+	assert.Equal(2, sb.bufferedRows)
+	assert.Equal(string(first)+"\n"+string(second)+"\n", string(sb.bufferedData))
+	assert.Equal([]string{string(first), string(second)}, packed)
+
+	// Keys are forgotten once the box is reset
+	sb.Reset()
+	assert.NoError(sb.Pack(duplicate))
+	assert.Equal(1, sb.bufferedRows)
+}
+
+func TestRecoverFileLocations(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		KeyPrefix:   "staging/",
+	})
+	assert.NoError(err)
+
+	// Listings are lexicographic, so file 10 precedes file 2
+	pages := [][]*s3.Object{
+		{
+			{Key: aws.String("staging/1000_0.gz")},
+			{Key: aws.String("staging/1000_1.gz")},
+			{Key: aws.String("staging/1000_10.gz")},
+		},
+		{
+			{Key: aws.String("staging/1000_2.gz")},
+			{Key: aws.String("staging/1000_table_0.manifest")}, // Not a data file
+			{Key: aws.String("staging/notes.txt")},             // Not a staged file
+		},
+	}
+	listS3ObjectsPage = func(s3Handler *s3.S3, bucket, prefix, token string) ([]*s3.Object, string, error) {
+		assert.Equal(s3Bucket, bucket)
+		assert.Equal("staging/1000_", prefix)
+		if token == "" {
+			return pages[0], "page2", nil
+		}
+		assert.Equal("page2", token)
+		return pages[1], "", nil
+	}
+	defer func() {
+		listS3ObjectsPage = listS3ObjectsPageProd
+	}()
+
+	assert.NoError(sb.RecoverFileLocations("staging/1000_"))
+	assert.Equal([]string{
+		"s3://test-bucket/staging/1000_0.gz",
+		"s3://test-bucket/staging/1000_1.gz",
+		"s3://test-bucket/staging/1000_2.gz",
+		"s3://test-bucket/staging/1000_10.gz",
+	}, sb.fileLocations)
+	assert.Equal(11, sb.fileCounter)
+	assert.True(sb.HasData())
+
+	manifests, err := sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal([]string{"staging/test_0.manifest"}, manifests)
+}
+
+func TestVerifyWriteAccess(t *testing.T) {
+	assert := assert.New(t)
+	var writtenKeys, deletedKeys []string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		writtenKeys = append(writtenKeys, key)
+		return int64(len(data)), nil
+	}
+	deleteS3Objects = func(s3Handler *s3.S3, bucket string, keys []string) error {
+		deletedKeys = append(deletedKeys, keys...)
+		return nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+		deleteS3Objects = deleteS3ObjectsProd
+	}()
+
+	options := Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		KeyPrefix:         "staging/",
+		VerifyWriteAccess: true,
+	}
+	_, err := NewS3Box(options)
+	assert.NoError(err)
+	assert.Equal(1, len(writtenKeys))
+	assert.True(strings.HasPrefix(writtenKeys[0], "staging/write_check_"))
+	assert.Equal(writtenKeys, deletedKeys)
+
+	// A failed write fails construction
+	writeToS3 = writeToS3Fail
+	_, err = NewS3Box(options)
+	assert.Error(err)
+	assert.Contains(err.Error(), "PutObject")
+}
+
+func TestFileSizes(t *testing.T) {
+	assert := assert.New(t)
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		size, err := compressedSize(data)
+		return size, err
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	data, _ := json.Marshal(map[string]interface{}{"id": "1234", "value": strings.Repeat("a", 1000)})
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  2 * (len(data) + 1),
+	})
+	assert.NoError(err)
+
+	// Each file holds three rows
+	for i := 0; i < 5; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	_, err = sb.DataFiles()
+	assert.NoError(err)
+
+	sizes := sb.FileSizes()
+	assert.Equal(len(sb.fileLocations), len(sizes))
+	expected, _ := compressedSize([]byte(strings.Repeat(string(data)+"\n", 3)))
+	assert.Equal(expected, sizes[0])
+	expected, _ = compressedSize([]byte(strings.Repeat(string(data)+"\n", 2)))
+	assert.Equal(expected, sizes[1])
+
+	sb.Reset()
+	assert.Empty(sb.FileSizes())
+}
+
+func TestVisibilityRetries(t *testing.T) {
+	assert := assert.New(t)
+	heads := map[string]int{}
+	headS3Object = func(s3Handler *s3.S3, bucket, key string) (bool, error) {
+		heads[key]++
+		// The second file only becomes visible on its third HEAD
+		return !strings.HasSuffix(key, "_1.gz") || heads[key] >= 3, nil
+	}
+	defer func() {
+		headS3Object = headS3ObjectProd
+	}()
+
+	options := Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		BufferSize:        1,
+		VisibilityRetries: 2,
+		Backoff:           ConstantBackoff(time.Millisecond),
+	}
+	sb, err := NewS3Box(options)
+	assert.NoError(err)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	_, err = sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	ts := sb.timestamp.UnixNano()
+	assert.Equal(map[string]int{
+		fmt.Sprintf("%d_0.gz", ts): 1,
+		fmt.Sprintf("%d_1.gz", ts): 3,
+		fmt.Sprintf("%d_2.gz", ts): 1,
+	}, heads)
+
+	// Files missing after every retry fail manifest creation, naming the files
+	heads = map[string]int{}
+	options.VisibilityRetries = 1
+	sb, err = NewS3Box(options)
+	assert.NoError(err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	_, err = sb.CreateManifests("test", 1)
+	assert.Error(err)
+	assert.Contains(err.Error(), fmt.Sprintf("%d_1.gz", sb.timestamp.UnixNano()))
+	assert.False(sb.isShipped)
+}
+
+func TestShardIDInKeys(t *testing.T) {
+	assert := assert.New(t)
+	var keys []string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		keys = append(keys, key)
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	options := Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  1,
+		KeyPrefix:   "staging/",
+		ShardID:     "worker-3",
+	}
+	sb, err := NewS3Box(options)
+	assert.NoError(err)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(sb.Pack(data))
+	assert.Equal([]string{fmt.Sprintf("staging/%d_worker-3_0.gz", sb.timestamp.UnixNano())}, keys)
+	assert.True(stagedKeyPattern.MatchString(strings.TrimPrefix(keys[0], "staging/")))
+
+	// Sharded keys are recovered like any others
+	listS3ObjectsPage = func(s3Handler *s3.S3, bucket, prefix, token string) ([]*s3.Object, string, error) {
+		return []*s3.Object{{Key: aws.String("staging/1000_worker-3_1.gz")}, {Key: aws.String("staging/1000_worker-3_0.gz")}}, "", nil
+	}
+	defer func() {
+		listS3ObjectsPage = listS3ObjectsPageProd
+	}()
+	assert.NoError(sb.RecoverFileLocations("staging/1000_worker-3_"))
+	assert.Equal([]string{
+		"s3://test-bucket/staging/1000_worker-3_0.gz",
+		"s3://test-bucket/staging/1000_worker-3_1.gz",
+	}, sb.fileLocations)
+
+	options.ShardID = "worker_3"
+	_, err = NewS3Box(options)
+	assert.Equal(errInvalidShardID, err)
+}
+
+func TestContentMD5(t *testing.T) {
+	assert := assert.New(t)
+	body := []byte(`{"key":"value"}`)
+	input := putObjectInput(s3Bucket, "key.gz", body)
+	checksum := md5.Sum(body)
+	assert.Equal(base64.StdEncoding.EncodeToString(checksum[:]), aws.StringValue(input.ContentMD5))
+	assert.Equal("key.gz", aws.StringValue(input.Key))
+
+	// Small files are put with a checksum, rather than uploaded in parts
+	var putBodies [][]byte
+	putS3Object = func(s3Handler *s3.S3, bucket, key string, body []byte) error {
+		putBodies = append(putBodies, body)
+		return nil
+	}
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		return 0, fmt.Errorf("unexpected multipart upload")
+	}
+	defer func() {
+		putS3Object = putS3ObjectProd
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		ContentMD5:  true,
+	})
+	assert.NoError(err)
+	assert.NoError(sb.Pack(body))
+	assert.NoError(sb.Flush())
+	assert.Equal(1, len(putBodies))
+
+	// The body is the gzipped data, whose size is reported
+	reader, err := gzip.NewReader(bytes.NewReader(putBodies[0]))
+	assert.NoError(err)
+	uncompressed, err := ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(string(body)+"\n", string(uncompressed))
+	assert.Equal([]int64{int64(len(putBodies[0]))}, sb.FileSizes())
+}
+
+func TestPackWithFlush(t *testing.T) {
+	assert := assert.New(t)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  len(data) + 1,
+	})
+	assert.NoError(err)
+
+	// The first row fits the buffer, the second overflows it
+	flushed, err := sb.PackWithFlush(data)
+	assert.NoError(err)
+	assert.False(flushed)
+	flushed, err = sb.PackWithFlush(data)
+	assert.NoError(err)
+	assert.True(flushed)
+	assert.Equal(1, len(sb.fileLocations))
+
+	// A failed flush isn't reported as one
+	writeToS3 = writeToS3Fail
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+	assert.NoError(sb.Pack(data))
+	flushed, err = sb.PackWithFlush(data)
+	assert.Error(err)
+	assert.False(flushed)
+}
+
+func TestWriteMetadata(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "metadata")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		BufferSize:    1,
+		KeyPrefix:     "redbox/",
+		ManifestStore: LocalManifestStore{Dir: dir},
+	})
+	assert.NoError(err)
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	_, err = sb.CreateManifests("test", 2)
+	assert.NoError(err)
+
+	location, err := sb.WriteMetadata("test", map[string]interface{}{"job_id": "job-1", "rows": -1})
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "redbox", "test.meta.json"), location)
+
+	metadataBytes, err := ioutil.ReadFile(location)
+	assert.NoError(err)
+	var metadata map[string]interface{}
+	assert.NoError(json.Unmarshal(metadataBytes, &metadata))
+	assert.Equal(map[string]interface{}{"job_id": "job-1", "files": float64(3), "rows": float64(3)}, metadata)
+}
+
+func TestDedupeConsecutive(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		DedupeConsecutive: true,
+	})
+	assert.NoError(err)
+
+	row, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	other, _ := json.Marshal(map[string]interface{}{"key": "other"})
+	for i := 0; i < 5; i++ {
+		assert.NoError(sb.Pack(row))
+	}
+	assert.Equal(1, sb.bufferedRows)
+	assert.Equal(string(row)+"\n", string(sb.bufferedData))
+
+	// Only consecutive duplicates are dropped
+	assert.NoError(sb.Pack(other))
+	assert.NoError(sb.Pack(row))
+	assert.Equal(3, sb.bufferedRows)
+}
+
+// recordingUploader records the keys and compression of each upload.
+type recordingUploader struct {
+	keys       []string
+	compressed []bool
+}
+
+func (u *recordingUploader) Upload(bucket, key string, data []byte, compress bool) (int64, error) {
+	u.keys = append(u.keys, key)
+	u.compressed = append(u.compressed, compress)
+	if compress {
+		return compressedSize(data)
+	}
+	return int64(len(data)), nil
+}
+
+func TestCustomUploader(t *testing.T) {
+	assert := assert.New(t)
+	// The default s3 upload mechanism must not be used, even to verify write access
+	writeToS3 = writeToS3Fail
+	deleteS3Objects = func(s3Handler *s3.S3, bucket string, keys []string) error {
+		return nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+		deleteS3Objects = deleteS3ObjectsProd
+	}()
+
+	uploader := &recordingUploader{}
+	sb, err := NewS3Box(Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		BufferSize:        1,
+		KeyPrefix:         "redbox/",
+		Uploader:          uploader,
+		VerifyWriteAccess: true,
+	})
+	assert.NoError(err)
+	if assert.Equal(1, len(uploader.keys)) {
+		assert.True(strings.HasPrefix(uploader.keys[0], "redbox/write_check_"))
+	}
+	uploader.keys, uploader.compressed = nil, nil
+
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(sb.Pack(data))
+	manifests, err := sb.CreateManifests("test", 1)
+	assert.NoError(err)
+
+	assert.Equal([]string{strings.TrimPrefix(sb.fileLocations[0], fmt.Sprintf("s3://%s/", s3Bucket)), manifests[0]}, uploader.keys)
+	assert.Equal([]bool{true, false}, uploader.compressed)
+	expected, _ := compressedSize([]byte(string(data) + "\n"))
+	assert.Equal([]int64{expected}, sb.FileSizes())
+}
+
+// flakyManifestStore fails the first failures writes of each key.
+type flakyManifestStore struct {
+	failures int
+	attempts map[string]int
+}
+
+func (f *flakyManifestStore) WriteManifest(key string, data []byte) (string, error) {
+	f.attempts[key]++
+	if f.attempts[key] <= f.failures {
+		return "", fmt.Errorf("transient failure")
+	}
+	return key, nil
+}
+
+func TestMaxManifestRetries(t *testing.T) {
+	assert := assert.New(t)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	newBox := func(store ManifestStore, retries int) *S3Box {
+		sb, err := NewS3Box(Options{
+			S3Bucket:           s3Bucket,
+			AWSKey:             awsKey,
+			AWSPassword:        awsPassword,
+			BufferSize:         1,
+			ManifestStore:      store,
+			MaxManifestRetries: retries,
+			Backoff:            ConstantBackoff(0),
+		})
+		assert.NoError(err)
+		for i := 0; i < 2; i++ {
+			assert.NoError(sb.Pack(data))
+		}
+		return sb
+	}
+
+	// A manifest failing its first attempt is retried
+	store := &flakyManifestStore{failures: 1, attempts: map[string]int{}}
+	manifests, err := newBox(store, 1).CreateManifests("test", 2)
+	assert.NoError(err)
+	assert.Equal([]string{"test_0.manifest", "test_1.manifest"}, manifests)
+	assert.Equal(map[string]int{"test_0.manifest": 2, "test_1.manifest": 2}, store.attempts)
+
+	// On permanent failure, the manifests already written are reported
+	store = &flakyManifestStore{failures: 2, attempts: map[string]int{"test_0.manifest": 2}}
+	sb := newBox(store, 1)
+	_, err = sb.CreateManifests("test", 2)
+	uploadErr, ok := err.(*ManifestUploadError)
+	assert.True(ok)
+	assert.Equal([]string{"test_0.manifest"}, uploadErr.Written)
+	assert.False(sb.isShipped)
+}
+
+func TestVerifyFilesBeforeManifest(t *testing.T) {
+	assert := assert.New(t)
+	var heads []string
+	headS3Object = func(s3Handler *s3.S3, bucket, key string) (bool, error) {
+		heads = append(heads, key)
+		// The second file was deleted since it was written
+		return !strings.HasSuffix(key, "_1.gz"), nil
+	}
+	defer func() {
+		headS3Object = headS3ObjectProd
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:                  s3Bucket,
+		AWSKey:                    awsKey,
+		AWSPassword:               awsPassword,
+		BufferSize:                1,
+		VerifyFilesBeforeManifest: true,
+	})
+	assert.NoError(err)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	for i := 0; i < 3; i++ {
+		assert.NoError(sb.Pack(data))
+	}
+	_, err = sb.CreateManifests("test", 1)
+	assert.Error(err)
+	assert.Contains(err.Error(), fmt.Sprintf("%d_1.gz", sb.timestamp.UnixNano()))
+	assert.False(sb.isShipped)
+
+	// Each file is checked once, without retrying
+	assert.Equal(3, len(heads))
+}
+
+func TestGzipHeaders(t *testing.T) {
+	assert := assert.New(t)
+	uploaded := map[string][]byte{}
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		assert.False(gzip)
+		uploaded[key] = data
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		BufferSize:  1,
+		KeyPrefix:   "redbox/",
+		GzipHeaders: true,
+	})
+	assert.NoError(err)
+	data, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	assert.NoError(sb.Pack(data))
+
+	key := fmt.Sprintf("redbox/%d_0.gz", sb.timestamp.UnixNano())
+	reader, err := gzip.NewReader(bytes.NewReader(uploaded[key]))
+	assert.NoError(err)
+	assert.Equal(strings.TrimSuffix(key, ".gz"), reader.Name)
+	assert.Equal(sb.timestamp.Unix(), reader.ModTime.Unix())
+	decompressed, err := ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(string(data)+"\n", string(decompressed))
+}
+
+func TestCompact(t *testing.T) {
+	assert := assert.New(t)
+	objects := map[string][]byte{}
+	var deleted []string
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		objects[key] = data
+		return int64(len(data)), nil
+	}
+	getS3Object = func(s3Handler *s3.S3, bucket, key string) ([]byte, error) {
+		return objects[key], nil
+	}
+	deleteS3Objects = func(s3Handler *s3.S3, bucket string, keys []string) error {
+		deleted = append(deleted, keys...)
+		return nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+		getS3Object = getS3ObjectProd
+		deleteS3Objects = deleteS3ObjectsProd
+	}()
+
+	row, _ := json.Marshal(map[string]interface{}{"key": "value"})
+	rowSize := int64(len(row) + 1)
+	sb, err := NewS3Box(Options{
+		S3Bucket:      s3Bucket,
+		AWSKey:        awsKey,
+		AWSPassword:   awsPassword,
+		BufferSize:    1,
+		Debug:         true,
+		MaxObjectSize: 2 * rowSize,
+	})
+	assert.NoError(err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(sb.Pack(row))
+	}
+
+	manifests, err := sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal(1, len(manifests))
+
+	// Pairs of files are merged, leaving the last file as is
+	ts := sb.timestamp.UnixNano()
+	location := func(n int) string { return fmt.Sprintf("s3://%s/%d_%d.json", s3Bucket, ts, n) }
+	assert.Equal([]string{location(5), location(6), location(4)}, sb.fileLocations)
+	assert.Equal([]int64{2 * rowSize, 2 * rowSize, rowSize}, sb.FileSizes())
+	assert.Equal(strings.Repeat(string(row)+"\n", 2), string(objects[fmt.Sprintf("%d_5.json", ts)]))
+	assert.Equal([]string{fmt.Sprintf("%d_0.json", ts), fmt.Sprintf("%d_1.json", ts), fmt.Sprintf("%d_2.json", ts), fmt.Sprintf("%d_3.json", ts)}, deleted)
+	assert.Equal(5, sb.Stats().Rows)
+}
+
+func TestRandomKeySuffix(t *testing.T) {
+	assert := assert.New(t)
+	options := Options{
+		S3Bucket:        s3Bucket,
+		AWSKey:          awsKey,
+		AWSPassword:     awsPassword,
+		RandomKeySuffix: true,
+	}
+	first, err := NewS3Box(options)
+	assert.NoError(err)
+	second, err := NewS3Box(options)
+	assert.NoError(err)
+
+	// Boxes created in the same nanosecond still write distinct keys
+	second.timestamp = first.timestamp
+	assert.NotEqual(first.nextFileKey(), second.nextFileKey())
+	assert.True(dataFileKeyPattern.MatchString(first.nextFileKey()))
+
+	// The suffix follows any ShardID
+	options.ShardID = "shard"
+	sharded, err := NewS3Box(options)
+	assert.NoError(err)
+	assert.Equal(fmt.Sprintf("%d_shard-%s_0.gz", sharded.timestamp.UnixNano(), sharded.keySuffix), sharded.nextFileKey())
+
+	// Without the option, keys are deterministic
+	options.RandomKeySuffix = false
+	deterministic, err := NewS3Box(options)
+	assert.NoError(err)
+	assert.Equal(fmt.Sprintf("%d_shard_0.gz", deterministic.timestamp.UnixNano()), deterministic.nextFileKey())
+}
+
+func TestBalanceManifestsBySize(t *testing.T) {
+	assert := assert.New(t)
+	var manifests [][]byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		if strings.HasSuffix(key, ".manifest") {
+			manifests = append(manifests, data)
+		}
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	sb, err := NewS3Box(Options{
+		S3Bucket:               s3Bucket,
+		AWSKey:                 awsKey,
+		AWSPassword:            awsPassword,
+		BalanceManifestsBySize: true,
+	})
+	assert.NoError(err)
+	// One huge file alongside many small ones
+	sizes := []int64{1000, 10, 20, 500, 30, 490, 40, 50}
+	for i, size := range sizes {
+		sb.fileLocations = append(sb.fileLocations, fmt.Sprintf("s3://%s/%d.gz", s3Bucket, i))
+		sb.fileSizes = append(sb.fileSizes, size)
+	}
+	assert.Equal([]int{0, 1, 1, 1, 0, 1, 0, 1}, sb.manifestAssignments(2))
+
+	_, err = sb.CreateManifests("test", 3)
+	assert.NoError(err)
+	assert.Equal(3, len(manifests))
+	var totals []int64
+	for _, manifest := range manifests {
+		var parsed struct {
+			Entries []struct {
+				URL string `json:"url"`
+			} `json:"entries"`
+		}
+		assert.NoError(json.Unmarshal(manifest, &parsed))
+		var total int64
+		for _, entry := range parsed.Entries {
+			var i int
+			fmt.Sscanf(strings.TrimPrefix(entry.URL, fmt.Sprintf("s3://%s/", s3Bucket)), "%d.gz", &i)
+			total += sizes[i]
+		}
+		totals = append(totals, total)
+	}
+	// Round-robin would total 1540, 90 and 510 bytes. Instead the huge file
+	// is alone, while the rest balance the other two manifests
+	assert.Equal([]int64{1000, 570, 570}, totals)
+}
+
+func TestCreateManifestsConsistencyCheck(t *testing.T) {
+	assert := assert.New(t)
+	var sb *S3Box
+	var err error
+	sb, err = NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+		// Simulate a flush regression which drops a row
+		OnRowsFlushed: func(int) {
+			sb.fileRows--
+		},
+	})
+	assert.NoError(err)
+	assert.NoError(sb.Pack([]byte("{}")))
+	assert.NoError(sb.Pack([]byte("{}")))
+
+	_, err = sb.CreateManifests("test", 1)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "internal consistency error")
+		assert.Contains(err.Error(), "1 of 2 packed rows")
+	}
+	assert.False(sb.isShipped)
+
+	// As does listing the data files to COPY them directly
+	_, err = sb.DataFiles()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "1 of 2 packed rows")
+	}
+
+	// Residual buffered data also fails the check
+	sb.Reset()
+	sb.o.OnRowsFlushed = nil
+	assert.NoError(sb.Pack([]byte("{}")))
+	assert.NoError(sb.Flush())
+	sb.bufferedData = []byte("{}\n")
+	assert.Error(sb.checkFlushed())
+
+	sb.Reset()
+	assert.NoError(sb.Pack([]byte("{}")))
+	_, err = sb.CreateManifests("test", 1)
+	assert.NoError(err)
+}
+
+func TestS3AccessPointARN(t *testing.T) {
+	assert := assert.New(t)
+	var manifest []byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		if strings.HasSuffix(key, ".manifest") {
+			manifest = data
+		}
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	for _, arn := range []string{
+		"arn:aws:s3:us-west-2:123456789012",
+		"arn:aws:s3:us-west-2:1234:accesspoint/loads",
+		"arn:aws:s3:::loads",
+		"arn:aws:s3:us-west-2:123456789012:accesspoint/Loads_1",
+	} {
+		_, err := NewS3Box(Options{S3AccessPointARN: arn})
+		assert.Equal(errInvalidAccessPointARN, err, arn)
+	}
+
+	arn := "arn:aws-us-gov:s3:us-gov-west-1:123456789012:accesspoint/loads"
+	sb, err := NewS3Box(Options{
+		S3AccessPointARN: arn,
+		AWSKey:           awsKey,
+		AWSPassword:      awsPassword,
+	})
+	assert.NoError(err)
+	assert.Equal(arn, sb.o.S3Bucket)
+	assert.Equal("us-gov-west-1", sb.o.S3Region)
+
+	// Manifests reference data files through the access point
+	assert.NoError(sb.Pack([]byte("{}")))
+	manifests, err := sb.CreateManifests("test", 1)
+	assert.NoError(err)
+	assert.Equal([]string{"test_0.manifest"}, manifests)
+	assert.Contains(string(manifest), fmt.Sprintf(`"url":"s3://%s/%d_0.gz"`, arn, sb.timestamp.UnixNano()))
+}
+
+func TestVerifyManifestRoundtrip(t *testing.T) {
+	assert := assert.New(t)
+	objects := map[string][]byte{}
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		objects[key] = data
+		return int64(len(data)), nil
+	}
+	getS3Object = func(s3Handler *s3.S3, bucket, key string) ([]byte, error) {
+		return objects[key], nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+		getS3Object = getS3ObjectProd
+	}()
+
+	// Stores which can't read manifests back are rejected up front
+	_, err := NewS3Box(Options{
+		S3Bucket:                s3Bucket,
+		AWSKey:                  awsKey,
+		AWSPassword:             awsPassword,
+		ManifestStore:           &flakyManifestStore{},
+		VerifyManifestRoundtrip: true,
+	})
+	assert.Equal(errManifestStoreNotReadable, err)
+
+	newBox := func() *S3Box {
+		sb, err := NewS3Box(Options{
+			S3Bucket:                s3Bucket,
+			AWSKey:                  awsKey,
+			AWSPassword:             awsPassword,
+			VerifyManifestRoundtrip: true,
+		})
+		assert.NoError(err)
+		for i := 0; i < 4; i++ {
+			sb.fileLocations = append(sb.fileLocations, fmt.Sprintf("s3://%s/test_files_%d.json.gz", s3Bucket, i))
+		}
+		return sb
+	}
+
+	// Intact manifests pass
+	manifests, err := newBox().CreateManifests("test", 2)
+	assert.NoError(err)
+	assert.Equal([]string{"test_0.manifest", "test_1.manifest"}, manifests)
+
+	// A corrupted manifest fails, listing those already verified
+	getS3Object = func(s3Handler *s3.S3, bucket, key string) ([]byte, error) {
+		if key == "test_1.manifest" {
+			return []byte(`{"entries":[{"url":"s3://`), nil
+		}
+		return objects[key], nil
+	}
+	_, err = newBox().CreateManifests("test", 2)
+	if assert.IsType(&ManifestUploadError{}, err) {
+		assert.Equal([]string{"test_0.manifest"}, err.(*ManifestUploadError).Written)
+		assert.Contains(err.Error(), "manifest test_1.manifest doesn't parse")
+	}
+
+	// As does one missing entries
+	getS3Object = func(s3Handler *s3.S3, bucket, key string) ([]byte, error) {
+		return []byte(`{"entries":[{"url":"s3://bucket/test_files_0.json.gz","mandatory":true}]}`), nil
+	}
+	_, err = newBox().CreateManifests("test", 2)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "lists 1 entries after writing it, rather than 2")
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(s3manager.MinUploadPartSize), partSizeFor(0))
+	assert.Equal(int64(s3manager.MinUploadPartSize), partSizeFor(1<<20))
+
+	// Up to s3's 5TB object limit, uploads stay within the part count and part size limits
+	for _, size := range []int64{50 << 30, 100<<30 + 1, 5 << 40} {
+		partSize := partSizeFor(size)
+		assert.True(partSize*s3manager.MaxUploadParts >= size, "size %d", size)
+		assert.True(partSize <= 5<<30, "size %d", size)
+	}
+
+	// Streamed gzip bodies never exceed the bound, even when incompressible
+	data := make([]byte, 1<<20)
+	_, err := rand.Read(data)
+	assert.NoError(err)
+	compressed, err := gzipBytes(data)
+	assert.NoError(err)
+	assert.True(int64(len(compressed)) <= gzipBound(int64(len(data))))
+}
+
+func TestRotateTimestamp(t *testing.T) {
+	assert := assert.New(t)
+	sb, err := NewS3Box(Options{
+		S3Bucket:    s3Bucket,
+		AWSKey:      awsKey,
+		AWSPassword: awsPassword,
+	})
+	assert.NoError(err)
+	assert.NoError(sb.Pack([]byte("{}")))
+	first := sb.timestamp
+
+	// Buffered data must be flushed under the timestamp it was packed with
+	assert.Equal(errBufferNotFlushed, sb.RotateTimestamp())
+	assert.Equal(first, sb.timestamp)
+
+	assert.NoError(sb.Flush())
+	time.Sleep(time.Millisecond)
+	assert.NoError(sb.RotateTimestamp())
+	assert.True(sb.timestamp.After(first))
+	assert.NoError(sb.Pack([]byte("{}")))
+	assert.NoError(sb.Flush())
+
+	// Files of both timestamps are kept
+	assert.Equal([]string{
+		fmt.Sprintf("s3://%s/%d_0.gz", s3Bucket, first.UnixNano()),
+		fmt.Sprintf("s3://%s/%d_1.gz", s3Bucket, sb.timestamp.UnixNano()),
+	}, sb.fileLocations)
+}
@@ -0,0 +1,203 @@
+package s3box
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// errInvalidNumShards is returned when creating a ShardedS3Box without any shards
+	errInvalidNumShards = fmt.Errorf("a sharded s3box requires at least one shard")
+)
+
+// ShardedS3Box spreads packed rows across several independent buffers, each flushing
+// into its own data files, so concurrent producers upload in parallel rather than
+// waiting on a single buffer's lock. CreateManifests spans the data files of every shard.
+//
+// Rows are assigned round-robin, or by a hash of their key when a DedupeKeyFunc is set
+// so duplicates always meet in the same shard. As a result, the order in which rows
+// were packed is only preserved within each shard, not across data files. Per-box
+// settings such as BufferSize, MaxRecordsPerFile, MaxFilesBeforeShip and
+// DedupeConsecutive apply to each shard individually.
+type ShardedS3Box struct {
+	shards []*S3Box
+
+	// next counts the rows packed, assigning them round-robin
+	next uint64
+}
+
+// NewShardedS3Box creates a box of numShards shards, each an S3Box with the given options.
+// Every shard's ShardID is suffixed with its index, so their data file keys never collide.
+func NewShardedS3Box(options Options, numShards int) (*ShardedS3Box, error) {
+	if numShards <= 0 {
+		return nil, errInvalidNumShards
+	}
+
+	s := &ShardedS3Box{shards: make([]*S3Box, numShards)}
+	for i := range s.shards {
+		shardOptions := options
+		shardOptions.ShardID = fmt.Sprintf("%d", i)
+		if options.ShardID != "" {
+			shardOptions.ShardID = fmt.Sprintf("%s-%d", options.ShardID, i)
+		}
+		shard, err := NewS3Box(shardOptions)
+		if err != nil {
+			return nil, err
+		}
+		s.shards[i] = shard
+
+		// The remaining shards reuse the resolved region and needn't check access again
+		options.S3Region = shard.o.S3Region
+		options.VerifyWriteAccess = false
+	}
+	return s, nil
+}
+
+// Pack writes bytes into the buffer of the row's shard, which is output to s3 once full.
+func (s *ShardedS3Box) Pack(data []byte) error {
+	if s.shards[0].isShipped {
+		return errBoxIsShipped
+	}
+	return s.shardFor(data).Pack(data)
+}
+
+// shardFor returns the shard a row is packed into.
+func (s *ShardedS3Box) shardFor(data []byte) *S3Box {
+	if dedupeKeyFunc := s.shards[0].o.DedupeKeyFunc; dedupeKeyFunc != nil {
+		h := fnv.New32a()
+		h.Write([]byte(dedupeKeyFunc(data)))
+		return s.shards[h.Sum32()%uint32(len(s.shards))]
+	}
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return s.shards[n%uint64(len(s.shards))]
+}
+
+// Flush uploads the buffered data of every shard to s3, concurrently.
+func (s *ShardedS3Box) Flush() error {
+	if s.shards[0].isShipped {
+		return errBoxIsShipped
+	}
+	return s.flushAll()
+}
+
+// flushAll uploads the buffered data of every shard concurrently, returning the first error.
+func (s *ShardedS3Box) flushAll() error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func(i int, shard *S3Box) {
+			defer wg.Done()
+			shard.mt.Lock()
+			defer shard.mt.Unlock()
+			errs[i] = shard.dumpToS3()
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gather flushes every shard and moves the data files of all other shards
+// to the first, which then spans them when writing manifests.
+func (s *ShardedS3Box) gather() error {
+	if err := s.flushAll(); err != nil {
+		return err
+	}
+
+	primary := s.shards[0]
+	primary.mt.Lock()
+	defer primary.mt.Unlock()
+	for _, shard := range s.shards[1:] {
+		shard.mt.Lock()
+		primary.fileLocations = append(primary.fileLocations, shard.fileLocations...)
+		primary.fileSizes = append(primary.fileSizes, shard.fileSizes...)
+		primary.fileRows += shard.fileRows
+		primary.packedRows += shard.packedRows
+		shard.fileLocations = nil
+		shard.fileSizes = nil
+		shard.fileRows = 0
+		shard.packedRows = 0
+		shard.mt.Unlock()
+	}
+	return nil
+}
+
+// CreateManifests flushes every shard and splits the data files of all shards across
+// the input number of manifests, as with S3Box.CreateManifests. Pack must not be
+// called concurrently.
+func (s *ShardedS3Box) CreateManifests(manifestSlug string, nManifests int) ([]string, error) {
+	if err := s.gather(); err != nil {
+		return nil, err
+	}
+	manifests, err := s.shards[0].CreateManifests(manifestSlug, nManifests)
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range s.shards[1:] {
+		shard.mt.Lock()
+		shard.isShipped = true
+		shard.mt.Unlock()
+	}
+	return manifests, nil
+}
+
+// PlanManifests flushes every shard and returns the manifest keys CreateManifests would create.
+func (s *ShardedS3Box) PlanManifests(manifestSlug string, nManifests int) ([]string, error) {
+	if err := s.gather(); err != nil {
+		return nil, err
+	}
+	return s.shards[0].PlanManifests(manifestSlug, nManifests)
+}
+
+// WriteMetadata writes the metadata next to the manifests, as with S3Box.WriteMetadata,
+// counting the files and rows of all shards.
+func (s *ShardedS3Box) WriteMetadata(manifestSlug string, metadata map[string]interface{}) (string, error) {
+	if err := s.gather(); err != nil {
+		return "", err
+	}
+	return s.shards[0].WriteMetadata(manifestSlug, metadata)
+}
+
+// DataFiles flushes every shard and returns the locations of the data files of all shards.
+func (s *ShardedS3Box) DataFiles() ([]string, error) {
+	if err := s.gather(); err != nil {
+		return nil, err
+	}
+	return s.shards[0].DataFiles()
+}
+
+// Stats reports the number of data files and rows written to s3 by all shards so far.
+func (s *ShardedS3Box) Stats() Stats {
+	var stats Stats
+	for _, shard := range s.shards {
+		shardStats := shard.Stats()
+		stats.Files += shardStats.Files
+		stats.Rows += shardStats.Rows
+	}
+	return stats
+}
+
+// HasData indicates whether any shard has buffered data or already written data to s3.
+func (s *ShardedS3Box) HasData() bool {
+	for _, shard := range s.shards {
+		if shard.HasData() {
+			return true
+		}
+	}
+	return false
+}
+
+// Reset resets every shard, readying the box for a new load.
+func (s *ShardedS3Box) Reset() {
+	for _, shard := range s.shards {
+		shard.Reset()
+	}
+}
@@ -0,0 +1,85 @@
+package s3box
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedS3Box(t *testing.T) {
+	assert := assert.New(t)
+	var mt sync.Mutex
+	var manifests [][]byte
+	writeToS3 = func(s3Handler *s3.S3, bucket, key string, data []byte, gzip bool) (int64, error) {
+		mt.Lock()
+		defer mt.Unlock()
+		if strings.HasSuffix(key, ".manifest") {
+			manifests = append(manifests, data)
+		}
+		return int64(len(data)), nil
+	}
+	defer func() {
+		writeToS3 = writeToS3Success
+	}()
+
+	_, err := NewShardedS3Box(Options{S3Bucket: s3Bucket}, 0)
+	assert.Equal(errInvalidNumShards, err)
+
+	sb, err := NewShardedS3Box(Options{
+		S3Bucket:          s3Bucket,
+		AWSKey:            awsKey,
+		AWSPassword:       awsPassword,
+		ShardID:           "worker",
+		MaxRecordsPerFile: 2,
+	}, 4)
+	assert.NoError(err)
+	assert.False(sb.HasData())
+
+	// Packing concurrently spreads rows evenly, each shard flushing its own files
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(sb.Pack([]byte(fmt.Sprintf(`{"row":%d}`, i))))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(Stats{Files: 4, Rows: 8}, sb.Stats())
+	assert.True(sb.HasData())
+
+	_, err = sb.CreateManifests("test", 2)
+	assert.NoError(err)
+	assert.Equal(2, len(manifests))
+	assert.Equal(Stats{Files: 8, Rows: 12}, sb.Stats())
+
+	// The manifests span the files of every shard
+	shards := map[string]int{}
+	for _, manifest := range manifests {
+		var parsed struct {
+			Entries []struct {
+				URL string `json:"url"`
+			} `json:"entries"`
+		}
+		assert.NoError(json.Unmarshal(manifest, &parsed))
+		for _, entry := range parsed.Entries {
+			match := dataFileKeyPattern.FindStringSubmatch(strings.TrimPrefix(entry.URL, fmt.Sprintf("s3://%s/", s3Bucket)))
+			if assert.NotNil(match) {
+				shards[match[2]]++
+			}
+		}
+	}
+	assert.Equal(map[string]int{"worker-0": 2, "worker-1": 2, "worker-2": 2, "worker-3": 2}, shards)
+
+	// Every shard is shipped along with the box
+	assert.Equal(errBoxIsShipped, sb.Pack([]byte("{}")))
+	assert.Equal(errBoxIsShipped, sb.Flush())
+	sb.Reset()
+	assert.False(sb.HasData())
+	assert.NoError(sb.Pack([]byte("{}")))
+}
@@ -0,0 +1,40 @@
+package s3box
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Uploader uploads the data files and manifests written by an S3Box.
+type Uploader interface {
+	// Upload writes data under the given bucket and key, gzip-compressing it if requested,
+	// and returns the number of bytes stored, which for compressed data is its compressed size.
+	Upload(bucket, key string, data []byte, compress bool) (int64, error)
+}
+
+// s3Uploader is the default Uploader, writing to s3 with the box's handler.
+type s3Uploader struct {
+	sb *S3Box
+}
+
+// Upload implements Uploader. With ContentMD5, bodies smaller than a multipart
+// upload's part are written with a checksummed PutObject.
+func (u s3Uploader) Upload(bucket, key string, data []byte, compress bool) (int64, error) {
+	if !u.sb.o.ContentMD5 {
+		return writeToS3(u.sb.s3Handler, bucket, key, data, compress)
+	}
+
+	body := data
+	if compress {
+		var err error
+		if body, err = gzipBytes(data); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(body)) >= s3manager.DefaultUploadPartSize {
+		return writeToS3(u.sb.s3Handler, bucket, key, body, false)
+	}
+	if err := putS3Object(u.sb.s3Handler, bucket, key, body); err != nil {
+		return 0, err
+	}
+	return int64(len(body)), nil
+}
@@ -0,0 +1,32 @@
+package redbox
+
+import (
+	"fmt"
+)
+
+var errInvalidShipLimit = fmt.Errorf("a ShipLimiter requires a positive capacity")
+
+// ShipLimiter bounds how many loads run at once across all boxes sharing it, e.g. to stay
+// within a cluster's COPY concurrency in multi-table pipelines. Further loads queue until
+// a slot frees up. A slot is held from the start of a load's transaction until it's
+// committed or rolled back. ShipLimiter is concurrency safe.
+type ShipLimiter struct {
+	// slots holds a token for each load in progress
+	slots chan struct{}
+}
+
+// NewShipLimiter creates a ShipLimiter allowing at most capacity concurrent loads.
+func NewShipLimiter(capacity int) (*ShipLimiter, error) {
+	if capacity <= 0 {
+		return nil, errInvalidShipLimit
+	}
+	return &ShipLimiter{slots: make(chan struct{}, capacity)}, nil
+}
+
+// acquire blocks until a slot is available, returning the function releasing it.
+func (l *ShipLimiter) acquire() func() {
+	l.slots <- struct{}{}
+	return func() {
+		<-l.slots
+	}
+}
@@ -0,0 +1,59 @@
+package redbox
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShipLimiterBoundsConcurrentLoads(t *testing.T) {
+	assert := assert.New(t)
+	limiter, err := NewShipLimiter(2)
+	assert.NoError(err)
+	options := testOptions
+	options.ShipLimiter = limiter
+
+	var mt sync.Mutex
+	running, maxRunning := 0, 0
+	load := func(tx *sql.Tx) error {
+		mt.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mt.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mt.Lock()
+		running--
+		mt.Unlock()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		redshift, mock, err := sqlmock.New()
+		assert.NoError(err)
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+		redbox := newRedboxInjection(options, &MockSuccessS3Box{}, redshift)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(redbox.loadToRedshift(schema, table, load))
+			assert.NoError(mock.ExpectationsWereMet())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(2, maxRunning)
+}
+
+func TestShipLimiterRequiresCapacity(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewShipLimiter(0)
+	assert.Equal(errInvalidShipLimit, err)
+}
@@ -0,0 +1,146 @@
+package redbox
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// defaultQueueSize is the default number of rows a StreamingIngester queues before blocking
+const defaultQueueSize = 1000
+
+var errIngesterClosed = fmt.Errorf("cannot enqueue rows, the ingester has been closed")
+
+// Packer is anything rows can be packed into, such as a Redbox or an s3box.S3Box.
+type Packer interface {
+	Pack(data []byte) error
+}
+
+// flusher is a Packer which buffers rows, such as a Redbox or an s3box.S3Box,
+// and can upload its buffer on demand.
+type flusher interface {
+	Flush() error
+}
+
+// StreamingIngester packs rows into a box from a background worker fed by a bounded queue.
+// Enqueue blocks while the queue is full, giving producers which outrun uploads
+// to s3 natural backpressure instead of growing memory.
+type StreamingIngester struct {
+	// mt guards closing the queue against concurrent enqueues
+	mt sync.RWMutex
+
+	// box receives the queued rows
+	box Packer
+
+	// rows is the bounded queue of rows waiting to be packed
+	rows chan []byte
+
+	// errs surfaces errors from packing rows
+	errs chan error
+
+	// pending counts rows enqueued but not yet packed, guarded by pendingMt
+	pending   int
+	pendingMt sync.Mutex
+
+	// drained is signalled whenever pending drops to zero
+	drained *sync.Cond
+
+	// done is closed once the worker has exited
+	done chan struct{}
+
+	// closed indicates the ingester accepts no further rows
+	closed bool
+}
+
+// NewStreamingIngester starts an ingester packing rows into the given box, queuing up to
+// queueSize rows before Enqueue blocks. queueSize defaults to 1000 if not positive.
+func NewStreamingIngester(box Packer, queueSize int) *StreamingIngester {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	si := &StreamingIngester{
+		box:  box,
+		rows: make(chan []byte, queueSize),
+		errs: make(chan error, queueSize),
+		done: make(chan struct{}),
+	}
+	si.drained = sync.NewCond(&si.pendingMt)
+	go si.work()
+	return si
+}
+
+// Enqueue queues a row for packing, blocking while the queue is full.
+func (si *StreamingIngester) Enqueue(row []byte) error {
+	si.mt.RLock()
+	defer si.mt.RUnlock()
+	if si.closed {
+		return errIngesterClosed
+	}
+	si.pendingMt.Lock()
+	si.pending++
+	si.pendingMt.Unlock()
+	si.rows <- row
+	return nil
+}
+
+// Errors surfaces errors from packing rows, and is closed once the ingester is closed.
+// The channel holds as many errors as the queue holds rows; further errors are logged and dropped.
+func (si *StreamingIngester) Errors() <-chan error {
+	return si.errs
+}
+
+// Drain blocks until every row enqueued so far has been packed, then flushes the box's
+// buffer to s3 if it has one. Rows enqueued concurrently may keep Drain waiting.
+func (si *StreamingIngester) Drain() error {
+	si.pendingMt.Lock()
+	for si.pending > 0 {
+		si.drained.Wait()
+	}
+	si.pendingMt.Unlock()
+	return si.flush()
+}
+
+// Close stops accepting rows, waiting for queued rows to be packed and flushing the box's
+// buffer to s3 if it has one, before stopping the worker.
+func (si *StreamingIngester) Close() error {
+	si.mt.Lock()
+	if si.closed {
+		si.mt.Unlock()
+		return nil
+	}
+	si.closed = true
+	close(si.rows)
+	si.mt.Unlock()
+
+	<-si.done
+	close(si.errs)
+	return si.flush()
+}
+
+// flush flushes the box, if it buffers rows.
+func (si *StreamingIngester) flush() error {
+	if box, ok := si.box.(flusher); ok {
+		return box.Flush()
+	}
+	return nil
+}
+
+// work packs queued rows until the queue is closed.
+func (si *StreamingIngester) work() {
+	defer close(si.done)
+	for row := range si.rows {
+		if err := si.box.Pack(row); err != nil {
+			select {
+			case si.errs <- err:
+			default:
+				log.Printf("Dropping ingester error, the error channel is full: %s\n", err)
+			}
+		}
+		si.pendingMt.Lock()
+		si.pending--
+		if si.pending == 0 {
+			si.drained.Broadcast()
+		}
+		si.pendingMt.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package redbox
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// MockBlockingPacker blocks each Pack until released, recording the packed rows.
+type MockBlockingPacker struct {
+	mt      sync.Mutex
+	release chan struct{}
+	rows    [][]byte
+}
+
+func (m *MockBlockingPacker) Pack(data []byte) error {
+	<-m.release
+	m.mt.Lock()
+	defer m.mt.Unlock()
+	m.rows = append(m.rows, data)
+	return nil
+}
+
+type MockFailingPacker struct {
+}
+
+func (m *MockFailingPacker) Pack(data []byte) error {
+	return fmt.Errorf("failed packing %s", data)
+}
+
+// MockFlushingPacker counts packed rows and flushes.
+type MockFlushingPacker struct {
+	mt      sync.Mutex
+	rows    int
+	flushes int
+}
+
+func (m *MockFlushingPacker) Pack(data []byte) error {
+	m.mt.Lock()
+	defer m.mt.Unlock()
+	m.rows++
+	return nil
+}
+
+func (m *MockFlushingPacker) Flush() error {
+	m.mt.Lock()
+	defer m.mt.Unlock()
+	m.flushes++
+	return nil
+}
+
+func TestEnqueueBlocksWhenQueueIsFull(t *testing.T) {
+	assert := assert.New(t)
+	packer := &MockBlockingPacker{release: make(chan struct{})}
+	ingester := NewStreamingIngester(packer, 2)
+
+	// The worker holds one row while blocked in Pack, and the queue holds two more
+	for i := 0; i < 3; i++ {
+		assert.NoError(ingester.Enqueue([]byte(fmt.Sprintf("row%d", i))))
+	}
+
+	enqueued := make(chan struct{})
+	go func() {
+		assert.NoError(ingester.Enqueue([]byte("row3")))
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("Enqueue should block while the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Releasing the packer unblocks the producer, and every row is eventually packed
+	close(packer.release)
+	<-enqueued
+	ingester.Drain()
+	assert.Equal([][]byte{[]byte("row0"), []byte("row1"), []byte("row2"), []byte("row3")}, packer.rows)
+
+	ingester.Close()
+	assert.Equal(errIngesterClosed, ingester.Enqueue([]byte("row4")))
+}
+
+func TestIngesterSurfacesErrors(t *testing.T) {
+	assert := assert.New(t)
+	ingester := NewStreamingIngester(&MockFailingPacker{}, 10)
+	assert.NoError(ingester.Enqueue([]byte("row0")))
+	assert.NoError(ingester.Enqueue([]byte("row1")))
+	ingester.Close()
+
+	var errs []error
+	for err := range ingester.Errors() {
+		errs = append(errs, err)
+	}
+	assert.Equal(2, len(errs))
+	assert.Equal("failed packing row0", errs[0].Error())
+}
+
+func TestDrainFlushesBox(t *testing.T) {
+	assert := assert.New(t)
+	packer := &MockFlushingPacker{}
+	ingester := NewStreamingIngester(packer, 10)
+
+	// Draining while other producers enqueue waits for the rows enqueued before it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(ingester.Enqueue([]byte("row")))
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(ingester.Drain())
+	}
+	wg.Wait()
+
+	assert.NoError(ingester.Drain())
+	assert.Equal(200, packer.rows)
+	assert.Equal(11, packer.flushes)
+
+	assert.NoError(ingester.Close())
+	assert.Equal(12, packer.flushes)
+}